@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"html"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -17,12 +20,23 @@ const tpl = `
 	<pre>IP: :ip:</pre>
 
 	<br>
-	<a href="/videos/">Videos</a>
+	<a href="/recordings">Recordings</a> | <a href="/videos/">Videos</a>
 	<hr>
 
 	<a href="/restart" onclick="return confirm('Are you sure?')">Restart</a> | <a href="/reboot" onclick="return confirm('Are you sure?')">Reboot OS</a> | <a href="/force-reboot" style="color:red" onclick="return confirm('This may DAMAGE your system. Are you sure?')">Force Reboot OS</a> | <a href="/clearlog" onclick="return confirm('Are you sure?')">Clear log</a>
 
 
+	<h4>Cameras</h4>
+	<pre>:cameras:</pre>
+	:previews:
+	<hr>
+	<br>
+
+	<h4>Live (open on VLC)</h4>
+	<pre>:live:</pre>
+	<hr>
+	<br>
+
 	<h4>Server Date</h4>
 	<pre>:date:</pre>
 	<pre>Up since: :started:</pre>
@@ -34,6 +48,16 @@ const tpl = `
 	<hr>
 	<br>
 
+	<h4>System</h4>
+	<pre>:system:</pre>
+	<hr>
+	<br>
+
+	<h4>Disk health (SMART)</h4>
+	<pre>:smart:</pre>
+	<hr>
+	<br>
+
 	<h4>Log</h4>
 	<pre id="logs">:log:</pre>
 	<hr>
@@ -61,8 +85,33 @@ const tpl = `
 func httpServer(addr, user, pass string) {
 	mux := http.NewServeMux()
 
-	fs := http.FileServer(http.Dir(config.VideosDir))
-	mux.Handle("/videos/", http.StripPrefix("/videos/", fs))
+	// follows the storage in use
+	mux.Handle("/videos/", http.StripPrefix("/videos/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(http.Dir(videosDir())).ServeHTTP(w, r)
+	})))
+
+	apiServer(mux)
+
+	mux.HandleFunc("/recordings", recordingsBrowser)
+
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	mux.HandleFunc("/preview/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/preview/"), ".jpg")
+		c, ok := cameraByName[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		file, rm, err := c.Preview()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer rm()
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeFile(w, r, file)
+	})
 
 	mux.HandleFunc("/log-raw", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
@@ -142,16 +191,26 @@ func httpServer(addr, user, pass string) {
 			dfOption = serverDF()
 		}
 
+		var previews = `<a href="/?withpreview=1">Show</a>`
+		if r.URL.Query().Get("withpreview") != "" {
+			previews = serverPreviews()
+		}
+
 		//logger.Printf("local ip: %v", ipsA)
 
 		replacer := strings.NewReplacer(
 			":started:", started.Format(time.RubyDate),
 			":date:", serverDate(),
 			":df:", dfOption,
+			":system:", serverSystem(),
+			":smart:", serverSMART(),
 			":log:", serverLog(),
 			":config:", serverConfig(),
 			":version:", version,
 			":ip:", localIP(),
+			":live:", serverLive(),
+			":previews:", previews,
+			":cameras:", html.EscapeString(serverCameras()),
 		)
 
 		w.Header().Set("Content-Type", "text/html")
@@ -159,6 +218,12 @@ func httpServer(addr, user, pass string) {
 	})
 
 	h := auth(user, pass, noCache(mux))
+	if !config.Admin.HealthAuth {
+		h = publicHealth(h)
+	} else {
+		mux.HandleFunc("/healthz", healthz)
+		mux.HandleFunc("/readyz", readyz)
+	}
 
 	if config.Admin.HTTPS.Enabled {
 		if config.Admin.HTTPS.CertPath == "" || config.Admin.HTTPS.KeyPath == "" {
@@ -218,3 +283,12 @@ func auth(user, pass string, next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+func serverPreviews() string {
+	var b strings.Builder
+	for _, c := range config.Cameras {
+		fmt.Fprintf(&b, `<figure style="display:inline-block"><img src="/preview/%s.jpg" width="320" loading="lazy"><figcaption>%s</figcaption></figure>`,
+			url.PathEscape(c.Name), html.EscapeString(c.Name))
+	}
+	return b.String()
+}
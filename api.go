@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+func apiServer(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/recordings", func(w http.ResponseWriter, r *http.Request) {
+		day := r.FormValue("day")
+		if day == "" {
+			days, err := listDays()
+			if err != nil {
+				apiError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, map[string]interface{}{"days": append([]string{}, days...)})
+			return
+		}
+
+		recs, err := dayRecordings(videosDir(), cleanRel(day))
+		if err != nil {
+			apiError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		infos := make([]recordingInfo, 0, len(recs))
+		for _, rec := range recs {
+			if camera := r.FormValue("camera"); camera != "" && camera != rec.camera {
+				continue
+			}
+			infos = append(infos, rec.info())
+		}
+		writeJSON(w, map[string]interface{}{"day": day, "recordings": infos})
+	})
+
+	mux.HandleFunc("/api/v1/storage", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, storagesStatus())
+	})
+
+	mux.HandleFunc("/api/v1/cameras", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, camerasStatus())
+	})
+
+	mux.HandleFunc("/api/v1/system", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, currentSystem())
+	})
+
+	mux.HandleFunc("/api/v1/disks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, disksHealth())
+	})
+
+	mux.HandleFunc("/api/v1/queue", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, queueStatus())
+	})
+
+	mux.HandleFunc("/api/v1/protected", func(w http.ResponseWriter, r *http.Request) {
+		ranges := protectedRanges()
+		if ranges == nil {
+			ranges = []protectedRange{}
+		}
+		writeJSON(w, map[string]interface{}{
+			"files":  append([]string{}, protectedFiles()...),
+			"ranges": ranges,
+		})
+	})
+
+	mux.HandleFunc("/api/v1/protect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apiError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+		if file := r.FormValue("file"); file != "" {
+			if err := protectFile(file); err != nil {
+				apiError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeJSON(w, map[string]string{"protected": cleanRel(file)})
+			return
+		}
+
+		pr, err := rangeFromRequest(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := protectRange(pr.Camera, pr.From, pr.To); err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, pr)
+	})
+
+	mux.HandleFunc("/api/v1/unprotect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apiError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+		if file := r.FormValue("file"); file != "" {
+			if err := unprotectFile(file); err != nil {
+				apiError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, map[string]string{"unprotected": cleanRel(file)})
+			return
+		}
+
+		pr, err := rangeFromRequest(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := unprotectRange(pr); err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, pr)
+	})
+
+	mux.HandleFunc("/api/v1/export", func(w http.ResponseWriter, r *http.Request) {
+		pr, err := rangeFromRequest(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		j, err := startExport(pr.Camera, pr.From, pr.To)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, j.snapshot())
+	})
+
+	// /api/v1/export/<id> and /api/v1/export/<id>/download
+	mux.HandleFunc("/api/v1/export/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/export/"), "/")
+		j, ok := getExport(parts[0])
+		if !ok {
+			apiError(w, http.StatusNotFound, "export not found")
+			return
+		}
+		s := j.snapshot()
+		if len(parts) == 1 {
+			writeJSON(w, s)
+			return
+		}
+		if parts[1] != "download" {
+			apiError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if s.Status != exportDone {
+			apiError(w, http.StatusConflict, "export is "+s.Status)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, path.Base(s.File)))
+		http.ServeFile(w, r, s.output)
+	})
+}
+
+// rangeFromRequest reads camera, from and to parameters.
+func rangeFromRequest(r *http.Request) (pr protectedRange, err error) {
+	pr.Camera = r.FormValue("camera")
+	if _, ok := cameraConfig(pr.Camera); !ok {
+		return pr, fmt.Errorf("unknown camera %q", pr.Camera)
+	}
+	if pr.From, err = parseTime(r.FormValue("from")); err != nil {
+		return
+	}
+	pr.To, err = parseTime(r.FormValue("to"))
+	return
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Printf("api: error encoding response: %s", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
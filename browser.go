@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+var browserTpl = template.Must(template.New("recordings").Funcs(template.FuncMap{
+	"mb": func(size int64) string {
+		return fmt.Sprintf("%.1fMB", float64(size)/(1<<20))
+	},
+	"secs": func(secs float64) string {
+		return (time.Duration(secs) * time.Second).String()
+	},
+}).Parse(`
+<!DOCTYPE html>
+<html charset="utf-8">
+<head>
+	<style>
+		.rec { display:inline-block; width:320px; margin:4px; vertical-align:top; }
+		.rec img { width:320px; height:180px; object-fit:cover; background:#ddd; }
+		#thumb { position:absolute; display:none; width:160px; height:90px; border:1px solid #000; }
+	</style>
+</head>
+<body>
+	<h3 style="color:blue">VigilantPI - Recordings</h3>
+	<a href="/">Admin</a> | <a href="/recordings">Days</a>
+	<hr>
+
+	{{if .Play}}
+		<h4>{{.Play.File}}</h4>
+		<video id="video" src="{{.Play.URL}}" width="960" controls preload="metadata"{{if .Play.Poster}} poster="{{.Play.Poster}}"{{end}}></video>
+		{{if .Play.Thumbnails}}
+		<br>
+		<input id="seek" type="range" min="0" max="1000" value="0" style="width:960px">
+		<div id="thumb"></div>
+		<script>
+			const video = document.getElementById('video');
+			const seek = document.getElementById('seek');
+			const thumb = document.getElementById('thumb');
+			const base = '{{.Play.Thumbnails}}'.replace(/[^/]*$/, '');
+			let cues = [];
+
+			const secs = t => t.split(':').reduce((acc, v) => acc * 60 + parseFloat(v), 0);
+			fetch('{{.Play.Thumbnails}}').then(r => r.text()).then(vtt => {
+				const re = /([\d:.]+) --> ([\d:.]+)\n(\S+)#xywh=(\d+),(\d+),(\d+),(\d+)/g;
+				let m;
+				while ((m = re.exec(vtt)) !== null) {
+					cues.push({start: secs(m[1]), end: secs(m[2]), file: m[3], x: m[4], y: m[5], w: m[6], h: m[7]});
+				}
+			});
+
+			seek.addEventListener('mousemove', e => {
+				if (!video.duration || !cues.length) return;
+				const rect = seek.getBoundingClientRect();
+				const t = (e.clientX - rect.left) / rect.width * video.duration;
+				const cue = cues.find(c => t >= c.start && t < c.end);
+				if (!cue) return;
+				thumb.style.display = 'block';
+				thumb.style.left = (e.pageX - cue.w / 2) + 'px';
+				thumb.style.top = (rect.top + window.scrollY - cue.h - 8) + 'px';
+				thumb.style.background = 'url(' + base + cue.file + ') -' + cue.x + 'px -' + cue.y + 'px';
+			});
+			seek.addEventListener('mouseleave', () => thumb.style.display = 'none');
+			seek.addEventListener('input', () => video.currentTime = seek.value / 1000 * video.duration);
+			video.addEventListener('timeupdate', () => seek.value = video.currentTime / video.duration * 1000);
+		</script>
+		{{end}}
+	{{else if .Day}}
+		<h4>{{.Day}}</h4>
+		{{range .Recordings}}
+		<div class="rec">
+			<a href="/recordings?day={{$.Day}}&play={{.File}}"><img src="{{.Poster}}" loading="lazy" alt="no preview"></a>
+			<br>{{if .Protected}}🔒 {{end}}{{.Camera}} - {{.Start.Format "15:04:05"}}{{if .Timelapse}} (timelapse){{end}} - {{mb .Size}}
+			{{if .Duration}}<br>{{secs .Duration}}{{if .Height}} - {{.Height}}p {{.Codec}}{{end}}{{if .Motion}} - {{.Motion}} motion events{{end}}{{end}}
+			<a href="{{.URL}}" download>download</a>
+		</div>
+		{{else}}
+		<pre>no recordings</pre>
+		{{end}}
+	{{else}}
+		{{range .Days}}
+		<a href="/recordings?day={{.}}">{{.}}</a><br>
+		{{else}}
+		<pre>no recordings</pre>
+		{{end}}
+	{{end}}
+</body>
+</html>
+`))
+
+// recordingsBrowser lists days, the recordings of a day with their posters
+// and plays a recording with thumbnails when seeking.
+func recordingsBrowser(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Days       []string
+		Day        string
+		Recordings []recordingInfo
+		Play       *recordingInfo
+	}{}
+
+	data.Day = cleanRel(r.FormValue("day"))
+	switch {
+	case data.Day == "":
+		days, err := listDays()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Days = days
+
+	default:
+		recs, err := dayRecordings(videosDir(), data.Day)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		play := r.FormValue("play")
+		for _, rec := range recs {
+			info := rec.info()
+			if play != "" && info.File == play {
+				data.Play = &info
+			}
+			data.Recordings = append(data.Recordings, info)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := browserTpl.Execute(w, data); err != nil {
+		logger.Printf("error rendering recordings: %s", err)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"os/exec"
 	"path"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,6 +22,9 @@ import (
 
 const (
 	minVideoDuration = time.Second * 50
+
+	// how long to wait before trying a failing substream again
+	subRetryInterval = time.Minute * 5
 )
 
 var (
@@ -39,6 +44,7 @@ func init() {
 type Camera struct {
 	Name                      string   `yaml:"name"`
 	URL                       string   `yaml:"url"`
+	SubURL                    string   `yaml:"sub_url"`
 	Audio                     bool     `yaml:"audio"`
 	VideoCodec                string   `yaml:"video_codec"`
 	AudioCodec                string   `yaml:"audio_codec"`
@@ -50,6 +56,10 @@ type Camera struct {
 	PreRec                    []string      `yaml:"pre_rec"`
 	AfterRec                  []string `yaml:"after_rec"`
 	DisableParallelTransition bool     `yaml:"disable_parallel_transition"`
+	Recorder                  string   `yaml:"recorder"`
+	Retention                 *Retention `yaml:"retention"`
+	// transcode profile used when converting, streams are copied by default
+	Profile                   string   `yaml:"profile"`
 	MotionDetection           *struct {
 		SnapshotInterval time.Duration `yaml:"snapshot_interval"`
 		MinDistance      int           `yaml:"min_distance"`
@@ -60,7 +70,27 @@ type Camera struct {
 			End   time.Duration `yaml:"end"`
 		} `yaml:"time_range"`
 	} `yaml:"motion_detection"`
-	healthy bool
+	// not recorded at all
+	Disabled bool `yaml:"disabled"`
+	// records only in the window, durations since midnight. end may be
+	// before start to record overnight
+	Schedule *struct {
+		Start time.Duration `yaml:"start"`
+		End   time.Duration `yaml:"end"`
+	} `yaml:"schedule"`
+
+	// unix nano until when the substream shouldn't be tried again
+	subDownUntil int64
+}
+
+// cameraConfig finds a camera by name on the loaded config.
+func cameraConfig(name string) (*Camera, bool) {
+	for i := range config.Cameras {
+		if config.Cameras[i].Name == name {
+			return &config.Cameras[i], true
+		}
+	}
+	return nil, false
 }
 
 func (c *Camera) SetupMotionDetection() {
@@ -98,7 +128,7 @@ func (c *Camera) SetupMotionDetection() {
 					return
 				}
 			}
-			path, rm, err = c.Snapshot()
+			path, rm, err = c.Preview()
 			if err != nil {
 				logger.Printf("md: error taking snapshot on %s: %s", c.Name, err)
 				return
@@ -156,9 +186,17 @@ func (c *Camera) SetupMotionDetection() {
 					lastRm = emptyFn
 					rm = emptyFn
 
-					telegramNotify(TelegramNotification{
+					recordMotion(c.Name, t)
+					haMotion(c.Name, path)
+
+					if !armed() {
+						return
+					}
+					notify(Notification{
 						Text:   fmt.Sprintf("Motion detection on camera %s. (distance: %d)", c.Name, distance),
 						Images: []string{lastPath, path},
+						Event:  eventMotion,
+						Source: c.Name,
 					})
 				}()
 			}
@@ -175,21 +213,43 @@ func (c *Camera) SetupMotionDetection() {
 	}()
 }
 
+// Snapshot takes a full quality snapshot from the main stream.
 func (c *Camera) Snapshot() (fpath string, rm func() error, err error) {
-	dir := path.Join(videosDir, "snapshots")
+	return c.snapshot(c.inputURL(), "")
+}
+
+// Preview takes a snapshot from the substream when there is one, falling
+// back to the main stream while the substream is down.
+func (c *Camera) Preview() (fpath string, rm func() error, err error) {
+	if c.SubURL == "" || time.Now().UnixNano() < atomic.LoadInt64(&c.subDownUntil) {
+		return c.Snapshot()
+	}
+
+	fpath, rm, err = c.snapshot(c.subInputURL(), "_sub")
+	if err == nil {
+		return
+	}
+
+	logger.Printf("substream of %s is down, using main stream: %s", c.Name, err)
+	atomic.StoreInt64(&c.subDownUntil, time.Now().Add(subRetryInterval).UnixNano())
+	return c.Snapshot()
+}
+
+func (c *Camera) snapshot(input, suffix string) (fpath string, rm func() error, err error) {
+	dir := path.Join(videosDir(), "snapshots")
 	if err := os.MkdirAll(dir, 0774); err != nil {
 		return "", nil, err
 	}
 
-	fpath = fmt.Sprintf("%s/%s_%s.jpg", dir, c.Name, time.Now().Format("2006_01_02_15_04_05"))
-    
+	fpath = fmt.Sprintf("%s/%s_%s%s.jpg", dir, c.Name, time.Now().Format("2006_01_02_15_04_05"), suffix)
+
     var optTransport string
-    if c.RTSPTransport != "" {
+    if c.RTSPTransport != "" && strings.HasPrefix(input, "rtsp://") {
         optTransport = "-rtsp_transport " + c.RTSPTransport
     }
 
 	const cmd = `ffmpeg -y -i '%s' %s -ss 00:00:01.500 -f image2 -vframes 1 '%s'`
-	out, err := exec.Command("bash", "-c", fmt.Sprintf(cmd, c.URL, optTransport, fpath)).Output()
+	out, err := exec.Command("bash", "-c", fmt.Sprintf(cmd, input, optTransport, fpath)).Output()
 	if err != nil {
 		return "", nil, fmt.Errorf("err: %s - out: %s", err, out)
 	}
@@ -199,13 +259,21 @@ func (c *Camera) Snapshot() (fpath string, rm func() error, err error) {
 	return
 }
 
-func (c *Camera) Unhealthy() {
-	c.healthy = false
-
+// inputURL is the address consumers should read the camera from.
+// It's the local relay when relaying is enabled.
+func (c *Camera) inputURL() string {
+	if _, ok := relayFor(c.Name); ok {
+		return relayURL(c.Name)
+	}
+	return c.URL
 }
 
-func (c *Camera) Healthy() {
-	c.healthy = true
+// subInputURL is the substream counterpart of inputURL.
+func (c *Camera) subInputURL() string {
+	if _, ok := relayFor(c.Name + subRelaySuffix); ok {
+		return relayURL(c.Name + subRelaySuffix)
+	}
+	return c.SubURL
 }
 
 func (c *Camera) HealthCheck() func() {
@@ -213,14 +281,14 @@ func (c *Camera) HealthCheck() func() {
 		u, err := url.Parse(c.URL)
 		if err != nil {
 			logger.Printf("error parsing camera (%s) url: %s", c.Name, err)
-			led.BadCamera()
+			c.state().setError(err)
 			return
 		}
 
 		pinger, err := ping.NewPinger(u.Hostname())
 		if err != nil {
 			logger.Printf("error trying to ping camera %s: %s", c.Name, err)
-			led.BadCamera()
+			c.state().setError(err)
 			return
 		}
 		pinger.SetPrivileged(true)
@@ -236,12 +304,9 @@ func (c *Camera) HealthCheck() func() {
 				c.Name,
 				stats.PacketsSent, stats.PacketsRecv, stats.PacketLoss,
 			)
-			led.BadCamera()
+			c.state().setError(fmt.Errorf("not responding to ping"))
 			return
 		}
-		//c.Healthy()
-
-		led.On()
 	}
 
 	t := time.NewTicker(time.Minute * 5)
@@ -292,26 +357,40 @@ const (
 
 func record(ctx context.Context, c *Camera, stillProcessing chan<- struct{}) {
 	start := time.Now()
-	dayDir := start.Format(dayDirLayout)
+	fileName := segmentName(c, start)
 
-	targetExt := c.Extension
-	if targetExt == "" {
-		targetExt = "mp4"
-	}
-
-	fileName := dayDir + "-" + start.Format("15_04_05_") + c.Name + "." + targetExt + ".ts"
-
-	if !hddIsMounted() {
+	// fails over to the next storage when the current one is gone
+	if !hddIsMounted() && checkStorages() == nil {
 		logger.Println("can't record: hdd is not mounted")
-		telegramNotifyf("error: HD is not working")
+		notifyCriticalf(eventStorage, "", "error: HD is not working")
+		// not ok, so the camera waits before trying again
+		c.state().recordingEnded(0, errNoStorage)
 		led.BadHD()
-		tryMount()
 		return
 	}
 
+	st := c.state()
+	if wait := c.untilScheduled(start); wait > 0 {
+		st.transition(camIdle)
+		logger.Printf("%s is out of its schedule, waiting %s", c.Name, wait.Round(time.Second))
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+			st.transition(camStarting)
+		}
+		return
+	}
+
+	// the recorders stop when the window ends
+	if end := c.scheduleEnd(start); !end.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, end)
+		defer cancel()
+	}
+
 	var err error
 
-	tmpDir := path.Join(videosDir, ".tmp")
+	tmpDir := path.Join(videosDir(), ".tmp")
 	if err = os.MkdirAll(tmpDir, 0774); err != nil {
 		logger.Printf("error creating tmp directory %s: %s", tmpDir, err)
 		led.BadHD()
@@ -323,65 +402,35 @@ func record(ctx context.Context, c *Camera, stillProcessing chan<- struct{}) {
 
 	c.RunPreRecTasks()
 
-	if c.healthy {
-		logger.Printf("recording %s (%s)...\n", c.Name, fileName)
-	}
-
-	codec := c.VideoCodec
-	if codec == "" {
-		codec = "copy"
-	}
-
-	if c.InRate <= 0 {
-		c.InRate = 10
-	}
-
-	if c.OutRate <= 0 {
-		c.OutRate = 10
-	}
-
-	args := []string{
-		ffmpeg,
-		"-nostdin",
-		"-nostats",
-		"-y",
-		"-r",
-		fmt.Sprintf("%.1f", c.InRate),
-	}
+	switch c.Recorder {
+	case recorderNative:
+		if st.ok() {
+			logger.Printf("recording %s (native)...\n", c.Name)
+		}
+		err := recordNative(ctx, c, tmpDir)
+		if err != nil {
+			logger.Printf("error on native recorder for %s - %s", c.Name, err)
+		}
+		c.checkRecording(ctx, start, err)
+		return
 
-	if c.RTSPTransport != "" {
-		args = append(args, "-rtsp_transport", c.RTSPTransport)
+	case recorderSegment:
+		if st.ok() {
+			logger.Printf("recording %s (segment)...\n", c.Name)
+		}
+		err := recordSegments(ctx, c, tmpDir)
+		if err != nil {
+			logger.Printf("error running ffmpeg for %s - %s", c.Name, err)
+		}
+		c.checkRecording(ctx, start, err)
+		return
 	}
 
-	// robustness flags:
-	// -timeout: general input timeout (microseconds)
-	if c.Timeout > 0 {
-		args = append(
-			args,
-			"-timeout", strconv.FormatInt(c.Timeout.Microseconds(), 10),
-		)
+	if st.ok() {
+		logger.Printf("recording %s (%s)...\n", c.Name, fileName)
 	}
 
-	args = append(
-		args,
-		"-i",
-		c.URL,
-		"-c:v",
-		codec,
-		"-r",
-		fmt.Sprintf("%.1f", c.OutRate),
-	)
-
-	if !c.Audio {
-		args = append(args, "-an")
-	} else {
-		audioCodec := c.AudioCodec
-		if audioCodec == "" {
-			audioCodec = "copy"
-		}
-
-		args = append(args, "-c:a", audioCodec)
-	}
+	args := c.ffmpegArgs()
 
 	filePath := path.Join(tmpDir, fileName)
 
@@ -398,16 +447,16 @@ func record(ctx context.Context, c *Camera, stillProcessing chan<- struct{}) {
 		close(signals)
 	}()
 
-	finished := make(chan struct{}, 1)
+	finished := make(chan error, 1)
 
 	go func() {
 		err := execProcess(ffmpeg, args, signals)
 		if err != nil {
 			logger.Printf("error running ffmpeg for %s - %s", c.Name, err)
-			led.BadCamera()
 		}
-		FilesToConvert <- filePath
-		finished <- struct{}{}
+		segmentDone(c.Name, filePath, start)
+		enqueue(jobConvert, filePath, priorityNormal)
+		finished <- err
 	}()
 
 	shouldInterrupt := make(chan struct{}, 1)
@@ -424,7 +473,7 @@ func record(ctx context.Context, c *Camera, stillProcessing chan<- struct{}) {
 		logger.Printf("SIGINT sent to %s", c.Name)
 
 		select {
-		case <-finished:
+		case err = <-finished:
 		case <-time.After(config.TerminationTimeout):
 			signals <- syscall.SIGKILL
 			logger.Printf("SIGKILL sent to %s", c.Name)
@@ -435,29 +484,11 @@ func record(ctx context.Context, c *Camera, stillProcessing chan<- struct{}) {
 		signals <- syscall.SIGINT
 		logger.Printf("SIGINT sent to %s", c.Name)
 
-	case <-finished:
+	case err = <-finished:
 		logger.Printf("recording %s finished", c.Name)
 	}
 
-	took := time.Since(start)
-
-	if took < minVideoDuration {
-		if c.healthy {
-			logger.Printf("camera %s is unhealthy. recording took %s", c.Name, took)
-			telegramNotifyf("error: camera %s is not recording", c.Name)
-		}
-		led.BadCamera()
-		c.Unhealthy()
-	} else {
-		if !c.healthy {
-			telegramNotifyf("camera %s is now recording", c.Name)
-		}
-		c.Healthy()
-	}
-
-	if c.healthy {
-		logger.Printf("recording %s took %s\n", c.Name, took)
-	}
+	c.checkRecording(ctx, start, err)
 
     c.RunAfterRecTasks(map[string]string{
 		"file_path": filePath,
@@ -468,6 +499,94 @@ func record(ctx context.Context, c *Camera, stillProcessing chan<- struct{}) {
 		"start_datetime": start.Format("2006-01-02 15:04:05"),
 	})
 }
+
+// checkRecording updates the camera state based on how long the last
+// recording (or native session) lasted. The camera is idle when its
+// schedule window ended.
+func (c *Camera) checkRecording(ctx context.Context, start time.Time, err error) {
+	took := time.Since(start)
+	st := c.state()
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Printf("recording %s stopped, schedule window ended", c.Name)
+		st.transition(camIdle)
+		return
+	}
+	st.recordingEnded(took, err)
+
+	if st.ok() {
+		logger.Printf("recording %s took %s\n", c.Name, took)
+	}
+}
+
+// ffmpegArgs returns the ffmpeg command line up to the output options.
+func (c *Camera) ffmpegArgs() []string {
+	codec := c.VideoCodec
+	if codec == "" {
+		codec = "copy"
+	}
+
+	if c.InRate <= 0 {
+		c.InRate = 10
+	}
+
+	if c.OutRate <= 0 {
+		c.OutRate = 10
+	}
+
+	args := []string{
+		ffmpeg,
+		"-nostdin",
+		"-nostats",
+		"-y",
+		"-r",
+		fmt.Sprintf("%.1f", c.InRate),
+	}
+
+	input := c.inputURL()
+	if c.RTSPTransport != "" && input == c.URL {
+		args = append(args, "-rtsp_transport", c.RTSPTransport)
+	}
+
+	// robustness flags:
+	// -timeout: general input timeout (microseconds)
+	if c.Timeout > 0 {
+		args = append(
+			args,
+			"-timeout", strconv.FormatInt(c.Timeout.Microseconds(), 10),
+		)
+	}
+
+	args = append(
+		args,
+		"-i",
+		input,
+		"-c:v",
+		codec,
+		"-r",
+		fmt.Sprintf("%.1f", c.OutRate),
+	)
+
+	if !c.Audio {
+		args = append(args, "-an")
+	} else {
+		audioCodec := c.AudioCodec
+		if audioCodec == "" {
+			audioCodec = "copy"
+		}
+
+		args = append(args, "-c:a", audioCodec)
+	}
+
+	return args
+}
+
+func (c *Camera) targetExt() string {
+	if c.Extension == "" {
+		return "mp4"
+	}
+	return c.Extension
+}
+
 func execProcess(ffmpeg string, args []string, signal chan syscall.Signal) error {
 	logger.Println("running")
 
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// camera states
+const (
+	camStarting     = "starting"
+	camRecording    = "recording"
+	camReconnecting = "reconnecting"
+	camFailing      = "failing"
+	camDisabled     = "disabled"
+	camIdle         = "idle" // out of its schedule
+)
+
+// consecutive failed recordings before a camera is failing
+const cameraFailingAfter = 3
+
+// cameraState follows a camera across its recordings. Telegram and the
+// led are only notified on transitions.
+type cameraState struct {
+	mu sync.Mutex
+
+	name        string
+	state       string
+	since       time.Time
+	lastSegment time.Time
+	lastError   string
+	lastErrorAt time.Time
+	failures    int
+
+	// time spent on each state
+	spent map[string]time.Duration
+}
+
+// cameraStatus is a copy of the state for the api.
+type cameraStatus struct {
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	Since       time.Time  `json:"since"`
+	LastSegment *time.Time `json:"last_segment,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	Failures    int        `json:"consecutive_failures"`
+	// percent of the time recording, disabled and idle time excluded
+	Uptime float64 `json:"uptime"`
+}
+
+var (
+	cameraStatesMu sync.Mutex
+	cameraStates   = make(map[string]*cameraState)
+)
+
+func (c *Camera) state() *cameraState {
+	return cameraStateOf(c.Name)
+}
+
+func cameraStateOf(name string) *cameraState {
+	cameraStatesMu.Lock()
+	defer cameraStatesMu.Unlock()
+	st, ok := cameraStates[name]
+	if !ok {
+		st = &cameraState{
+			name:  name,
+			state: camStarting,
+			since: time.Now(),
+			spent: make(map[string]time.Duration),
+		}
+		cameraStates[name] = st
+	}
+	return st
+}
+
+// transition moves to a state, notifying the change when it's a new one.
+func (s *cameraState) transition(to string) {
+	s.mu.Lock()
+	from := s.state
+	if from == to {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	s.spent[from] += now.Sub(s.since)
+	s.state, s.since = to, now
+	lastErr := s.lastError
+	s.mu.Unlock()
+
+	s.notify(from, to, lastErr)
+}
+
+func (s *cameraState) notify(from, to, lastErr string) {
+	switch to {
+	case camReconnecting, camFailing:
+		logger.Printf("camera %s: %s -> %s (%s)", s.name, from, to, lastErr)
+	default:
+		logger.Printf("camera %s: %s -> %s", s.name, from, to)
+	}
+	haCameraChanged(s.name)
+
+	switch to {
+	case camRecording:
+		if from == camFailing {
+			notifyf(eventCamera, s.name, "camera %s is now recording", s.name)
+		}
+		if allCamerasOK() {
+			led.On()
+		}
+	case camReconnecting:
+		led.BadCamera()
+	case camFailing:
+		led.BadCamera()
+		notifyf(eventCamera, s.name, "error: camera %s is not recording: %s", s.name, lastErr)
+	case camDisabled, camIdle:
+		if allCamerasOK() {
+			led.On()
+		}
+	}
+}
+
+// segmentDone records a finished segment of a camera. Empty and short
+// segments, left by failures, don't count as recorded.
+func segmentDone(camera, file string, start time.Time) {
+	info, err := os.Stat(file)
+	if err != nil || info.Size() == 0 || time.Since(start) < minVideoDuration {
+		return
+	}
+	s := cameraStateOf(camera)
+	s.mu.Lock()
+	s.lastSegment = time.Now()
+	s.failures = 0
+	s.mu.Unlock()
+	s.transition(camRecording)
+}
+
+// recordingEnded is called every time the recorder of a camera returns.
+// Recordings shorter than minVideoDuration are failures.
+func (s *cameraState) recordingEnded(took time.Duration, err error) {
+	if took >= minVideoDuration && err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if err == nil {
+		err = fmt.Errorf("recording took %s", took.Round(time.Second))
+	}
+	s.lastError, s.lastErrorAt = err.Error(), time.Now()
+	if took < minVideoDuration {
+		s.failures++
+	} else {
+		// long recording interrupted, reconnected right away
+		s.failures = 1
+	}
+	to := camReconnecting
+	if s.failures >= cameraFailingAfter {
+		to = camFailing
+	}
+	s.mu.Unlock()
+	s.transition(to)
+}
+
+// setError keeps an error not changing the state, like a failed ping.
+func (s *cameraState) setError(err error) {
+	s.mu.Lock()
+	s.lastError, s.lastErrorAt = err.Error(), time.Now()
+	s.mu.Unlock()
+}
+
+func (s *cameraState) current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// ok is false while the camera can't record.
+func (s *cameraState) ok() bool {
+	return okState(s.current())
+}
+
+func okState(state string) bool {
+	return state != camReconnecting && state != camFailing
+}
+
+func (s *cameraState) status() cameraStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := cameraStatus{
+		Name:      s.name,
+		State:     s.state,
+		Since:     s.since,
+		LastError: s.lastError,
+		Failures:  s.failures,
+	}
+	if !s.lastSegment.IsZero() {
+		t := s.lastSegment
+		st.LastSegment = &t
+	}
+	if !s.lastErrorAt.IsZero() {
+		t := s.lastErrorAt
+		st.LastErrorAt = &t
+	}
+
+	spent := make(map[string]time.Duration, len(s.spent)+1)
+	for k, v := range s.spent {
+		spent[k] = v
+	}
+	spent[s.state] += time.Since(s.since)
+	var total time.Duration
+	for k, v := range spent {
+		if k != camDisabled && k != camIdle {
+			total += v
+		}
+	}
+	if total > 0 {
+		st.Uptime = 100 * float64(spent[camRecording]) / float64(total)
+	}
+	return st
+}
+
+func camerasStatus() []cameraStatus {
+	statuses := []cameraStatus{}
+	for name := range cameraByName {
+		statuses = append(statuses, cameraStateOf(name).status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+func allCamerasOK() bool {
+	for name := range cameraByName {
+		if !cameraStateOf(name).ok() {
+			return false
+		}
+	}
+	return true
+}
+
+// untilScheduled is how long to wait for the schedule of the camera to
+// start, zero when it can record at t.
+func (c *Camera) untilScheduled(t time.Time) time.Duration {
+	if c.Schedule == nil || c.Schedule.Start == c.Schedule.End {
+		return 0
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	start, end := midnight.Add(c.Schedule.Start), midnight.Add(c.Schedule.End)
+
+	if c.Schedule.Start < c.Schedule.End {
+		switch {
+		case t.Before(start):
+			return start.Sub(t)
+		case !t.Before(end):
+			return start.AddDate(0, 0, 1).Sub(t)
+		}
+		return 0
+	}
+	// overnight, like 20h to 6h
+	if !t.Before(end) && t.Before(start) {
+		return start.Sub(t)
+	}
+	return 0
+}
+
+// scheduleEnd is when the window the camera is recording at t ends, zero
+// when it records all day.
+func (c *Camera) scheduleEnd(t time.Time) time.Time {
+	if c.Schedule == nil || c.Schedule.Start == c.Schedule.End {
+		return time.Time{}
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	end := midnight.Add(c.Schedule.End)
+	if !t.Before(end) {
+		// overnight window started today
+		end = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(c.Schedule.End)
+	}
+	return end
+}
+
+func serverCameras() string {
+	var b strings.Builder
+	for _, st := range camerasStatus() {
+		line := fmt.Sprintf("%s: %s since %s, uptime %.1f%%", st.Name, st.State, st.Since.Format("Jan _2 15:04:05"), st.Uptime)
+		if st.LastSegment != nil {
+			line += ", last segment " + st.LastSegment.Format("15:04:05")
+		}
+		if st.Failures > 0 {
+			line += fmt.Sprintf(", %d failures", st.Failures)
+		}
+		if st.LastError != "" {
+			line += fmt.Sprintf(", last error at %s: %s", st.LastErrorAt.Format("Jan _2 15:04:05"), st.LastError)
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+type cameraSchedule = struct {
+	Start time.Duration `yaml:"start"`
+	End   time.Duration `yaml:"end"`
+}
+
+func TestScheduleEnd(t *testing.T) {
+	day := func(h, m int) time.Time {
+		return time.Date(2026, 10, 18, h, m, 0, 0, time.Local)
+	}
+	for _, tt := range []struct {
+		start, end time.Duration
+		at         time.Time
+		want       time.Time
+	}{
+		{0, 0, day(10, 0), time.Time{}},
+		{8 * time.Hour, 18 * time.Hour, day(10, 0), day(18, 0)},
+		// overnight, before and after midnight
+		{20 * time.Hour, 6 * time.Hour, day(22, 0), day(30, 0)},
+		{20 * time.Hour, 6 * time.Hour, day(2, 30), day(6, 0)},
+	} {
+		c := &Camera{Schedule: &cameraSchedule{Start: tt.start, End: tt.end}}
+		if got := c.scheduleEnd(tt.at); !got.Equal(tt.want) {
+			t.Errorf("%s-%s at %s: got %s, want %s", tt.start, tt.end, tt.at.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+// TestRecordStopsAtScheduleEnd runs a segment recorder that would never
+// finish inside a window ending a couple of seconds later.
+func TestRecordStopsAtScheduleEnd(t *testing.T) {
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	sinceMidnight := now.Sub(midnight)
+	if sinceMidnight < time.Minute || sinceMidnight > 24*time.Hour-time.Minute {
+		t.Skip("too close to midnight")
+	}
+
+	dir := t.TempDir()
+	fakeFFMPEG := path.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\ntrap 'exit 0' INT\nwhile true; do sleep 0.1; done\n"
+	if err := ioutil.WriteFile(fakeFFMPEG, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	prevConfig, prevFFMPEG, prevStorage := config, ffmpeg, activeStorage
+	defer func() { config, ffmpeg, activeStorage = prevConfig, prevFFMPEG, prevStorage }()
+	config = &Config{TerminationTimeout: time.Second * 5}
+	confReplacer = map[string]string{}
+	ffmpeg = fakeFFMPEG
+	activeStorage = &Storage{Name: "test", VideosDir: path.Join(dir, "videos")}
+
+	c := &Camera{
+		Name:     "scheduled",
+		URL:      "rtsp://127.0.0.1/stream",
+		Recorder: recorderSegment,
+		Schedule: &cameraSchedule{Start: sinceMidnight - time.Minute, End: sinceMidnight + time.Second*2},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		record(context.Background(), c, make(chan struct{}, 1))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("still recording after the end of the window")
+	}
+
+	if took := time.Since(now); took < time.Second {
+		t.Errorf("recording stopped after %s, before the window ended", took)
+	}
+	if state := c.state().current(); state != camIdle {
+		t.Errorf("got state %s, want %s", state, camIdle)
+	}
+}
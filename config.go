@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,13 +16,20 @@ import (
 // Config yaml ...
 type Config struct {
 	FFMPEG             string        `yaml:"ffmpeg"`
+	FFProbe            string        `yaml:"ffprobe"`
 	MountDir           string        `yaml:"mount_dir"`
 	MountDev           string        `yaml:"mount_dev"`
 	MountLabel         string        `yaml:"mount_label"`
+	MountUUID          string        `yaml:"mount_uuid"`
+	MountFSType        string        `yaml:"mount_fs_type"`
+	MountOptions       string        `yaml:"mount_options"`
+	MountFsck          bool          `yaml:"mount_fsck"`
 	PreventHDDSpindown bool          `yaml:"prevent_hdd_spindown"`
 	TerminationTimeout time.Duration `yaml:"termination_timeout"`
 
-	HealthCheckURL string `yaml:"health_check_url"`
+	// deprecated, replaced by heartbeat.url
+	HealthCheckURL string    `yaml:"health_check_url"`
+	Heartbeat      Heartbeat `yaml:"heartbeat"`
 
 	Admin struct {
 		User  string `yaml:"user"`
@@ -32,13 +41,33 @@ type Config struct {
 			CertPath string `yaml:"cert_path"`
 			KeyPath  string `yaml:"key_path"`
 		} `yaml:"https"`
+		// requires user/pass on /healthz and /readyz
+		HealthAuth bool `yaml:"health_auth"`
 	} `yaml:"admin"`
 
+	Relay struct {
+		Enabled bool   `yaml:"enabled"`
+		Addr    string `yaml:"addr"`
+	} `yaml:"relay"`
+
+	DisableThumbnails bool `yaml:"disable_thumbnails"`
+
+	Queue Queue `yaml:"queue"`
+
+	Profiles  map[string]Profile `yaml:"profiles"`
+	Downgrade Downgrade          `yaml:"downgrade"`
+
 	VideosDir string        `yaml:"videos_dir"`
+	Storages  []Storage     `yaml:"storages"`
+	SMART     SMART         `yaml:"smart"`
+	System    SystemMonitor `yaml:"system"`
 	Duration  time.Duration `yaml:"duration"`
 	Cameras   []Camera      `yaml:"cameras"`
 
-	DeleteAfterDays int `yaml:"delete_after_days"`
+	DeleteAfterDays int       `yaml:"delete_after_days"`
+	Retention       Retention `yaml:"retention"`
+
+	Timelapse Timelapse `yaml:"timelapse"`
 
 	DailyBackup struct {
 		ScpURL    string `yaml:"scp_url"`
@@ -56,6 +85,11 @@ type Config struct {
 
 	Tasks Tasks `yaml:"tasks"`
 
+	Notifications Notifications    `yaml:"notifications"`
+	Notifiers     []NotifierConfig `yaml:"notifiers"`
+
+	HomeAssistant HomeAssistant `yaml:"home_assistant"`
+
 	TelegramBot struct {
 		Token          string   `yaml:"token"`
 		Users          []string `yaml:"users"`
@@ -66,10 +100,52 @@ type Config struct {
 	Debug bool `yaml:"debug"`
 }
 
+// ByteSize accepts plain numbers or sizes like 500MB, 1.5GB or 2TB.
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	size, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+func parseByteSize(s string) (ByteSize, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := float64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   float64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(v * mult), nil
+}
+
 func updateConfig() {
-	newConfig := path.Join(videosDir, "config.yaml")
-	oldConfig := path.Join(videosDir, "config.old.yaml")
-	newConfigBkp := path.Join(videosDir, "config.bkp.yaml")
+	newConfig := path.Join(videosDir(), "config.yaml")
+	oldConfig := path.Join(videosDir(), "config.old.yaml")
+	newConfigBkp := path.Join(videosDir(), "config.bkp.yaml")
 	f, err := os.Open(newConfig)
 	if err != nil {
 		logger.Println("no config to update", err)
@@ -132,7 +208,7 @@ func updateConfig() {
 }
 
 func tryRollback() {
-	configBkp := path.Join(videosDir, "config.bkp.yaml")
+	configBkp := path.Join(videosDir(), "config.bkp.yaml")
 	f, err := os.Open(configBkp)
 	if err != nil {
 		return
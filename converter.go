@@ -1,96 +1,80 @@
 package main
 
 import (
+	"fmt"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
 )
 
-var FilesToConvert = make(chan string, 100)
-
-func StartConverter() {
-	go func() {
-		for tsFile := range FilesToConvert {
-			convert(tsFile)
-		}
-	}()
-}
-
-func convert(tsFile string) {
+// convert moves a recorded ts file to its final container on the day
+// directory, re-encoding it when the camera has a profile.
+// Safe to run again after an interruption.
+func convert(tsFile string) error {
 	if _, err := os.Stat(tsFile); os.IsNotExist(err) {
-		return
+		return nil
 	}
 
 	if !strings.HasSuffix(tsFile, ".ts") {
-		return
+		return fmt.Errorf("%s is not a ts file", tsFile)
 	}
 
 	// Filename format: rec_YYYY_MM_DD-HH_MM_SS_camera.ext.ts
 	fileName := filepath.Base(tsFile)
 	parts := strings.SplitN(fileName, "-", 2)
 	if len(parts) != 2 {
-		return
+		return fmt.Errorf("invalid recording name %s", fileName)
 	}
 
 	dayDir := parts[0]       // rec_YYYY_MM_DD
 	rest := parts[1]         // HH_MM_SS_camera.ext.ts
-	
+
 	// Final file name is rest minus ".ts"
 	finalFileName := strings.TrimSuffix(rest, ".ts")
-	targetExt := filepath.Ext(finalFileName)
 
-	// Create final directory
-	finalDir := path.Join(videosDir, dayDir)
+	// Create final directory, on the storage the file was recorded to
+	finalDir := path.Join(storageOf(tsFile).VideosDir, dayDir)
 	if err := os.MkdirAll(finalDir, 0774); err != nil {
-		logger.Printf("error creating final directory %s: %s", finalDir, err)
-		return
+		return fmt.Errorf("error creating final directory %s: %s", finalDir, err)
 	}
 
 	finalFilePath := path.Join(finalDir, finalFileName)
 
 	logger.Printf("converting %s to %s", tsFile, finalFilePath)
 
-	args := []string{"-y", "-i", tsFile, "-c", "copy"}
-	if strings.ToLower(targetExt) == ".mp4" {
-		args = append(args, "-movflags", "+faststart")
+	var profile Profile
+	if rec, ok := parseRecording(dayDir, finalFileName); ok {
+		if c, ok := cameraConfig(rec.camera); ok {
+			profile, _ = profileByName(c.Profile)
+		}
 	}
-	args = append(args, finalFilePath)
 
-	cmd := exec.Command(ffmpeg, args...)
-	
-	if out, err := cmd.CombinedOutput(); err != nil {
-		logger.Printf("error converting %s: %s\nOutput: %s", tsFile, err, string(out))
-		return
+	if err := transcode(tsFile, finalFilePath, profile); err != nil {
+		// files truncated by power cuts usually convert once remuxed
+		logger.Printf("error converting %s, repairing: %s", tsFile, err)
+		if rerr := repairVideo(tsFile); rerr != nil {
+			return fmt.Errorf("%s (repair failed: %s)", err, rerr)
+		}
+		if err := transcode(tsFile, finalFilePath, profile); err != nil {
+			return err
+		}
 	}
 
 	logger.Printf("conversion finished: %s", finalFilePath)
 
-	if err := os.Remove(tsFile); err != nil {
-		logger.Printf("error removing original ts file %s: %s", tsFile, err)
+	if entry := verifyRecording(finalFilePath); !entry.OK {
+		notifyf(eventRecording, entry.Camera, "Recording %s is damaged: %s", path.Join(dayDir, finalFileName), entry.Error)
 	}
-}
 
-func ScanExistingFiles() {
-	go func() {
-		tmpDir := path.Join(videosDir, ".tmp")
-		if _, err := os.Stat(tmpDir); os.IsNotExist(err) {
-			return
+	if !config.DisableThumbnails {
+		if err := generateThumbnails(finalFilePath); err != nil {
+			logger.Printf("error generating thumbnails of %s: %s", finalFilePath, err)
 		}
+	}
 
-		err := filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() && strings.HasSuffix(path, ".ts") {
-				logger.Printf("found orphaned file: %s", path)
-				FilesToConvert <- path
-			}
-			return nil
-		})
-		if err != nil {
-			logger.Printf("error scanning for existing .ts files in .tmp: %s", err)
-		}
-	}()
+	if err := os.Remove(tsFile); err != nil {
+		logger.Printf("error removing original ts file %s: %s", tsFile, err)
+	}
+	return nil
 }
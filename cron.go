@@ -1,9 +1,6 @@
 package main
 
 import (
-	"io/ioutil"
-	"os"
-	"path"
 	"time"
 )
 
@@ -36,46 +33,12 @@ func crond(entries []Cron) {
 	}
 }
 
-func oldFilesWatcher(days int) {
-	if days <= 0 {
-		days = 20
-	}
-
-	ticker := time.NewTicker(6 * time.Hour)
-	deleteOldStuff := func() {
-		logger.Println("checking old content")
-		files, err := ioutil.ReadDir(videosDir)
-		if err != nil {
-			logger.Printf("error getting files on %s when deleting old content: %s", videosDir, err)
-			return
-		}
-
-		periodAgo := time.Now().AddDate(0, 0, -days)
-		logger.Println("deleting files older than", periodAgo.Format("02/01/2006"))
-
-		for _, f := range files {
-			if !f.IsDir() {
-				continue
-			}
-			fileTime, err := time.Parse(dayDirLayout, f.Name())
-			if err != nil {
-				continue
-			}
-			if !fileTime.Before(periodAgo) {
-				continue
-			}
-			go func(path string) {
-				logger.Printf("deleting %s", path)
-				if err := os.RemoveAll(path); err != nil {
-					logger.Printf("error deleting %s: %s", path, err)
-				}
-			}(path.Join(videosDir, f.Name()))
-		}
-	}
-
-	go deleteOldStuff()
+func oldFilesWatcher() {
+	ticker := time.NewTicker(retentionInterval)
+	go enforceRetention()
 
 	for range ticker.C {
-		deleteOldStuff()
+		enforceRetention()
+		pruneExports()
 	}
 }
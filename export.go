@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	exportsDir = "exports"
+
+	// exported clips are removed after that
+	exportTTL = time.Hour * 48
+)
+
+const (
+	exportQueued  = "queued"
+	exportRunning = "running"
+	exportDone    = "done"
+	exportFailed  = "failed"
+)
+
+var (
+	exportMutex sync.Mutex
+	exportByID  = make(map[string]*exportJob)
+)
+
+type exportJob struct {
+	ID       string    `json:"id"`
+	Camera   string    `json:"camera"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Status   string    `json:"status"`
+	Progress float64   `json:"progress"`
+	File     string    `json:"file,omitempty"`
+	Error    string    `json:"error,omitempty"`
+
+	output   string
+	done     chan struct{}
+	finished time.Time
+}
+
+// snapshot returns a copy safe to be read while the job runs.
+func (j *exportJob) snapshot() exportJob {
+	exportMutex.Lock()
+	defer exportMutex.Unlock()
+	return *j
+}
+
+func (j *exportJob) update(fn func(j *exportJob)) {
+	exportMutex.Lock()
+	defer exportMutex.Unlock()
+	fn(j)
+}
+
+func getExport(id string) (*exportJob, bool) {
+	exportMutex.Lock()
+	defer exportMutex.Unlock()
+	j, ok := exportByID[id]
+	return j, ok
+}
+
+// exportSegments finds the recordings of camera overlapping from-to.
+func exportSegments(camera string, from, to time.Time) ([]recording, error) {
+	recs, err := listRecordings(videosDir())
+	if err != nil {
+		return nil, err
+	}
+
+	var found []recording
+	for i, rec := range recs {
+		if rec.camera != camera || rec.timelapse {
+			continue
+		}
+		end := rec.end
+		for _, next := range recs[i+1:] {
+			if next.camera == camera && !next.timelapse {
+				if next.start.Before(end) {
+					end = next.start
+				}
+				break
+			}
+		}
+		if rec.start.Before(to) && end.After(from) {
+			found = append(found, rec)
+		}
+	}
+	return found, nil
+}
+
+// startExport cuts and concatenates the recordings of a camera into a
+// single mp4 in background.
+func startExport(camera string, from, to time.Time) (*exportJob, error) {
+	if _, ok := cameraConfig(camera); !ok {
+		return nil, fmt.Errorf("unknown camera %q", camera)
+	}
+	if !to.After(from) {
+		return nil, errors.New("invalid time range")
+	}
+
+	segments, err := exportSegments(camera, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("no recordings of %s between %s and %s", camera, from.Format("02/01/2006 15:04"), to.Format("02/01/2006 15:04"))
+	}
+
+	dir := path.Join(videosDir(), exportsDir)
+	if err := os.MkdirAll(dir, 0774); err != nil {
+		return nil, err
+	}
+	cleanExports(dir)
+	pruneExports()
+
+	id := make([]byte, 6)
+	rand.Read(id)
+
+	name := fmt.Sprintf("%s_%s_%s.mp4", camera, from.Format("2006_01_02_15_04_05"), to.Format("15_04_05"))
+	j := &exportJob{
+		ID:     hex.EncodeToString(id),
+		Camera: camera,
+		From:   from,
+		To:     to,
+		Status: exportQueued,
+		File:   path.Join(exportsDir, name),
+		output: path.Join(dir, name),
+		done:   make(chan struct{}),
+	}
+
+	exportMutex.Lock()
+	exportByID[j.ID] = j
+	exportMutex.Unlock()
+
+	go func() {
+		defer close(j.done)
+		j.update(func(j *exportJob) {
+			j.Status = exportRunning
+		})
+		logger.Printf("export %s: %s from %s to %s", j.ID, camera, from, to)
+		err := runExport(j, segments)
+		j.update(func(j *exportJob) {
+			j.finished = time.Now()
+			if err != nil {
+				j.Status = exportFailed
+				j.Error = err.Error()
+				return
+			}
+			j.Status = exportDone
+			j.Progress = 1
+		})
+		if err != nil {
+			logger.Printf("export %s failed: %s", j.ID, err)
+			return
+		}
+		logger.Printf("export %s finished: %s", j.ID, j.output)
+	}()
+
+	return j, nil
+}
+
+func runExport(j *exportJob, segments []recording) error {
+	listPath := j.output + ".txt"
+	var list strings.Builder
+	for i, rec := range segments {
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(rec.path, "'", `'\''`))
+		if i == 0 && j.From.After(rec.start) {
+			fmt.Fprintf(&list, "inpoint %.3f\n", j.From.Sub(rec.start).Seconds())
+		}
+		// the real end when read from the day index
+		end := rec.end
+		if end.IsZero() {
+			end = rec.start.Add(duration)
+		}
+		if i == len(segments)-1 && j.To.Before(end) {
+			fmt.Fprintf(&list, "outpoint %.3f\n", j.To.Sub(rec.start).Seconds())
+		}
+	}
+	if err := ioutil.WriteFile(listPath, []byte(list.String()), 0664); err != nil {
+		return err
+	}
+	defer os.Remove(listPath)
+
+	start := j.From
+	if segments[0].start.After(start) {
+		start = segments[0].start
+	}
+	total := j.To.Sub(start)
+
+	cmd := exec.Command(
+		ffmpeg,
+		"-nostdin", "-nostats", "-y",
+		"-f", "concat", "-safe", "0",
+		"-i", listPath,
+		"-c", "copy",
+		"-movflags", "+faststart",
+		"-progress", "pipe:1",
+		j.output,
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "out_time_us=") {
+			continue
+		}
+		us, err := strconv.ParseInt(strings.TrimPrefix(line, "out_time_us="), 10, 64)
+		if err != nil || total <= 0 {
+			continue
+		}
+		progress := float64(us) / float64(total.Microseconds())
+		if progress > 0.99 {
+			progress = 0.99
+		}
+		j.update(func(j *exportJob) {
+			j.Progress = progress
+		})
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s", err, lastLines(stderr.String(), 5))
+	}
+	return nil
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func cleanExports(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if time.Since(f.ModTime()) > exportTTL {
+			os.Remove(path.Join(dir, f.Name()))
+		}
+	}
+}
+
+// pruneExports forgets the jobs finished for longer than exportTTL,
+// removing their clips.
+func pruneExports() {
+	exportMutex.Lock()
+	defer exportMutex.Unlock()
+	for id, j := range exportByID {
+		if !j.finished.IsZero() && time.Since(j.finished) > exportTTL {
+			os.Remove(j.output)
+			delete(exportByID, id)
+		}
+	}
+}
+
+// exportCmd is `vigilantpi export <camera> <from> <to> [output]`.
+func exportCmd(args []string) error {
+	if len(args) < 3 {
+		return errors.New("usage: vigilantpi export <camera> <from> <to> [output]\nex.: vigilantpi export front_yard 2006-01-02T15:04 2006-01-02T16:00")
+	}
+	from, err := parseTime(args[1])
+	if err != nil {
+		return err
+	}
+	to, err := parseTime(args[2])
+	if err != nil {
+		return err
+	}
+
+	j, err := startExport(args[0], from, to)
+	if err != nil {
+		return err
+	}
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-t.C:
+			fmt.Fprintf(os.Stderr, "\rexporting... %3.0f%%", j.snapshot().Progress*100)
+		case <-j.done:
+			waiting = false
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+
+	s := j.snapshot()
+	if s.Status != exportDone {
+		return errors.New(s.Error)
+	}
+
+	if len(args) > 3 {
+		if err := moveFile(j.output, args[3]); err != nil {
+			return err
+		}
+		fmt.Println(args[3])
+		return nil
+	}
+	fmt.Println(j.output)
+	return nil
+}
+
+// moveFile renames src to dst, copying it when they are on different
+// filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -4,6 +4,7 @@ go 1.25.0
 
 require (
 	github.com/corona10/goimagehash v1.1.0
+	github.com/eclipse/paho.mqtt.golang v1.5.1
 	github.com/go-ping/ping v1.2.0
 	github.com/hashicorp/mdns v1.0.6
 	github.com/stianeikeland/go-rpio/v4 v4.6.0
@@ -13,6 +14,7 @@ require (
 
 require (
 	github.com/google/uuid v1.6.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/miekg/dns v1.1.72 // indirect
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
 	golang.org/x/mod v0.34.0 // indirect
@@ -1,95 +1,184 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
 )
 
 func hddIsMounted() bool {
-	if mountedDir == "" {
+	return currentStorage().mounted()
+}
+
+func (s *Storage) mounted() bool {
+	if s.MountDir == "" {
 		return true
 	}
-	res, err := exec.Command("lsblk", "-o", "NAME,MOUNTPOINT", "--json").Output()
+	entries, err := readMountinfo()
 	if err != nil {
-		logger.Println("error on mount cmd", err)
+		logger.Printf("error reading %s: %s", mountinfoPath, err)
 		return false
 	}
-	var resp struct {
-		Devices []struct {
-			Name       string `json:"name"`
-			Mountpoint string `json:"mountpoint"`
-			Children   []struct {
-				Name       string `json:"name"`
-				Mountpoint string `json:"mountpoint"`
-			}
-		} `json:"blockdevices"`
-	}
-	err = json.Unmarshal(res[:], &resp)
+	_, ok := findMount(entries, s.MountDir)
+	return ok
+}
+
+// serializes mounts and fscks of the storages
+var mountMu sync.Mutex
+
+// legacy options, used on vfat and exfat when mount_options is empty
+const fatMountOptions = "umask=0022,gid=1000,uid=1000"
+
+// device resolves the storage block device from mount_dev, mount_uuid
+// or mount_label.
+func (s *Storage) device() (string, error) {
+	switch {
+	case s.MountDev != "":
+		return s.MountDev, nil
+	case s.MountUUID != "":
+		return blkid("-U", s.MountUUID)
+	case s.MountLabel != "":
+		return blkid("-L", s.MountLabel)
+	}
+	return "", errors.New("no mount_dev, mount_uuid or mount_label")
+}
+
+func blkid(args ...string) (string, error) {
+	out, err := exec.Command("blkid", args...).Output()
 	if err != nil {
-		logger.Println("cant unmarshal lsblk response:", err)
-		return false
+		return "", fmt.Errorf("blkid %s: %s", strings.Join(args, " "), err)
 	}
-	for _, device := range resp.Devices {
-		if device.Mountpoint == mountedDir {
-			return true
-		}
-		for _, child := range device.Children {
-			if child.Mountpoint == mountedDir {
-				return true
-			}
-		}
+	res := strings.TrimSpace(string(out))
+	if res == "" {
+		return "", fmt.Errorf("blkid %s: not found", strings.Join(args, " "))
+	}
+	return res, nil
+}
+
+// fsck checks and repairs the filesystem of dev, at most once an hour.
+func (s *Storage) fsck(dev string) {
+	if !s.MountFsck || time.Since(s.lastFsck) < time.Hour {
+		return
+	}
+	s.lastFsck = time.Now()
+
+	logger.Printf("checking filesystem of %s (%s)...", s.Name, dev)
+	out, err := exec.Command("fsck", "-a", dev).CombinedOutput()
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		logger.Printf("error running fsck on %s: %s", dev, err)
+		return
+	}
+
+	// fsck exit codes are bit flags
+	switch {
+	case code == 0:
+		logger.Printf("filesystem of %s is clean", s.Name)
+	case code&4 != 0 || code&8 != 0:
+		logger.Printf("fsck could not fix %s (exit %d): %s", dev, code, out)
+		notifyCriticalf(eventStorage, s.Name, "fsck could not fix %s of %s (exit %d):\n%s", dev, s.Name, code, lastLines(string(out), 5))
+	default:
+		logger.Printf("fsck fixed errors on %s (exit %d): %s", dev, code, out)
+		notifyf(eventStorage, s.Name, "fsck fixed errors on %s of %s:\n%s", dev, s.Name, lastLines(string(out), 5))
 	}
-	return false
 }
 
-func tryMount() {
-	if mountDev == "" && mountLabel == "" {
+func (s *Storage) mount() {
+	if s.MountDev == "" && s.MountLabel == "" && s.MountUUID == "" {
 		return
 	}
-	if mountedDir == "" {
+	if s.MountDir == "" {
 		logger.Println("no mount directory specified")
 		return
 	}
-	logger.Println("trying to mount...")
-	args := []string{
-		"-t",
-		"vfat",
-		"-o",
-		"umask=0022,gid=1000,uid=1000",
+
+	mountMu.Lock()
+	defer mountMu.Unlock()
+	if s.mounted() {
+		return
 	}
 
-	if mountDev != "" {
-		args = append(args, mountDev)
+	logger.Printf("trying to mount %s...", s.Name)
+
+	var args []string
+	dev, err := s.device()
+	if err != nil {
+		if s.MountLabel == "" {
+			s.mountFailed(err)
+			return
+		}
+		// mount resolves labels by itself
+		logger.Printf("can't resolve device of %s: %s", s.Name, err)
+		args = append(args, "-L", s.MountLabel)
 	} else {
-		args = append(args, "-L", mountLabel)
+		s.fsck(dev)
+		args = append(args, dev)
 	}
 
-	args = append(args, mountedDir)
+	fsType := s.MountFSType
+	if fsType == "" && dev != "" {
+		if fsType, err = blkid("-o", "value", "-s", "TYPE", dev); err != nil {
+			logger.Printf("can't detect filesystem of %s: %s", dev, err)
+			fsType = ""
+		}
+	}
+	options := s.MountOptions
+	if options == "" && (fsType == "vfat" || fsType == "exfat") {
+		options = fatMountOptions
+	}
+
+	var flags []string
+	if fsType != "" {
+		flags = append(flags, "-t", fsType)
+	}
+	if options != "" {
+		flags = append(flags, "-o", options)
+	}
+	args = append(append(flags, args...), s.MountDir)
 
 	res, err := exec.Command(
 		"mount",
 		args...,
-	).Output()
+	).CombinedOutput()
 	if err != nil {
-		logger.Printf("error when trying to mount: %s. result: %s", err, string(res))
+		s.mountFailed(fmt.Errorf("%s: %s", err, strings.TrimSpace(string(res))))
 		return
 	}
+
+	logger.Printf("%s mounted on %s (mount %s)", s.Name, s.MountDir, strings.Join(args, " "))
+	notifyf(eventStorage, s.Name, "%s mounted on %s (%s)", s.Name, s.MountDir, strings.Join(flags, " "))
+	s.lastMountErr = ""
+
 	if config.PreventHDDSpindown {
-		if config.MountDev == "" {
-			logger.Printf("can't prevent hdd from spin down. mount_dev must be set")
+		if dev == "" {
+			logger.Printf("can't prevent hdd from spin down. unknown device")
 			return
 		}
 
 		logger.Printf("preventing hdd from spinning down (hdparm)")
 
-		if _, err := exec.Command("hdparm", "-B", "255", config.MountDev).Output(); err != nil {
+		if _, err := exec.Command("hdparm", "-B", "255", dev).Output(); err != nil {
 			logger.Printf("err disabling power management from hdd: %s", err)
 			return
 		}
 
-		if _, err := exec.Command("hdparm", "-S", "0", config.MountDev).Output(); err != nil {
+		if _, err := exec.Command("hdparm", "-S", "0", dev).Output(); err != nil {
 			logger.Printf("err disabling hdd spindown timeout: %s", err)
 			return
 		}
 	}
 }
+
+// mountFailed logs every failure, telegram only when the error changes.
+func (s *Storage) mountFailed(err error) {
+	logger.Printf("error when trying to mount %s: %s", s.Name, err)
+	if err.Error() != s.lastMountErr {
+		notifyf(eventStorage, s.Name, "can't mount %s: %s", s.Name, err)
+	}
+	s.lastMountErr = err.Error()
+}
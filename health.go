@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+	statusFail     = "fail"
+
+	// pending conversions above it degrade the health
+	maxHealthyBacklog = 20
+
+	telegramCheckInterval = time.Minute
+)
+
+// set once recording started
+var ready int32
+
+type componentHealth struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type cameraHealth struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	State       string     `json:"state"`
+	LastSegment *time.Time `json:"last_segment,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+type healthReport struct {
+	Status    string                     `json:"status"`
+	Version   string                     `json:"version"`
+	Uptime    float64                    `json:"uptime"`
+	Storage   componentHealth            `json:"storage"`
+	Disk      componentHealth            `json:"disk"`
+	Cameras   []cameraHealth             `json:"cameras"`
+	Converter componentHealth            `json:"converter"`
+	Telegram  componentHealth            `json:"telegram"`
+	Storages  map[string]componentHealth `json:"storages"`
+}
+
+// worse keeps the most severe status.
+func worse(a, b string) string {
+	rank := map[string]int{statusOK: 0, statusDegraded: 1, statusFail: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+func checkHealth() healthReport {
+	r := healthReport{
+		Status:   statusOK,
+		Version:  version,
+		Uptime:   time.Since(started).Seconds(),
+		Storages: make(map[string]componentHealth),
+	}
+
+	current := currentStorage()
+	for _, s := range storages {
+		h := componentHealth{Status: statusOK}
+		if ok, reason := s.healthy(); !ok {
+			h = componentHealth{Status: statusFail, Detail: reason}
+		}
+		r.Storages[s.Name] = h
+		if s == current {
+			r.Storage = componentHealth{Status: h.Status, Detail: "recording to " + s.Name}
+			if h.Status != statusOK {
+				r.Storage.Detail = s.Name + ": " + h.Detail
+			}
+		}
+	}
+
+	r.Disk = componentHealth{Status: statusOK}
+	if !current.diskHealthy() {
+		r.Disk = componentHealth{Status: statusDegraded, Detail: fmt.Sprintf("disk of %s is failing", current.Name)}
+	}
+
+	r.Cameras = camerasHealth()
+	failing := 0
+	for _, c := range r.Cameras {
+		if c.Status == statusFail {
+			failing++
+		}
+	}
+	cameras := componentHealth{Status: statusOK}
+	switch {
+	case failing > 0 && failing == len(r.Cameras):
+		cameras.Status = statusFail
+	case failing > 0:
+		cameras.Status = statusDegraded
+	}
+
+	q := queueStatus()
+	r.Converter = componentHealth{
+		Status: statusOK,
+		Detail: fmt.Sprintf("%d pending, %d retrying, %d quarantined", q.Pending, q.Retrying, len(q.Quarantined)),
+	}
+	if q.Pending > maxHealthyBacklog {
+		r.Converter.Status = statusDegraded
+	}
+
+	r.Telegram = telegramHealth()
+
+	for _, s := range []string{r.Storage.Status, r.Disk.Status, cameras.Status, r.Converter.Status, r.Telegram.Status} {
+		r.Status = worse(r.Status, s)
+	}
+	return r
+}
+
+// camerasHealth reports a camera as failing when its state is failing or
+// no segment was finished for twice the duration while recording.
+func camerasHealth() []cameraHealth {
+	stale := 2*duration + time.Minute*5
+	cameras := []cameraHealth{}
+	for _, st := range camerasStatus() {
+		h := cameraHealth{
+			Name:        st.Name,
+			Status:      statusOK,
+			State:       st.State,
+			LastSegment: st.LastSegment,
+			LastError:   st.LastError,
+		}
+		switch st.State {
+		case camFailing:
+			h.Status = statusFail
+		case camStarting, camReconnecting:
+			h.Status = "idle"
+			if time.Since(st.Since) > stale {
+				h.Status = statusFail
+			}
+		case camDisabled, camIdle:
+			h.Status = "idle"
+		case camRecording:
+			if st.LastSegment != nil && time.Since(*st.LastSegment) > stale {
+				h.Status = statusFail
+			}
+		}
+		cameras = append(cameras, h)
+	}
+	return cameras
+}
+
+var (
+	telegramCheckMu sync.Mutex
+	telegramChecked time.Time
+	telegramLast    componentHealth
+)
+
+// telegramHealth calls getMe at most once a minute.
+func telegramHealth() componentHealth {
+	if config.TelegramBot.Token == "" {
+		return componentHealth{Status: statusOK, Detail: "disabled"}
+	}
+	telegramCheckMu.Lock()
+	defer telegramCheckMu.Unlock()
+	if time.Since(telegramChecked) < telegramCheckInterval {
+		return telegramLast
+	}
+	telegramChecked = time.Now()
+
+	bot := b
+	switch {
+	case bot == nil:
+		telegramLast = componentHealth{Status: statusDegraded, Detail: "bot not started"}
+	default:
+		if _, err := bot.Raw("getMe", nil); err != nil {
+			telegramLast = componentHealth{Status: statusDegraded, Detail: err.Error()}
+		} else {
+			telegramLast = componentHealth{Status: statusOK, Detail: "connected"}
+		}
+	}
+	return telegramLast
+}
+
+// healthz is 200 while recording, even degraded.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	report := checkHealth()
+	writeHealth(w, report.Status == statusFail, report)
+}
+
+// readyz is 200 once recording started on a healthy storage.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	status := componentHealth{Status: statusOK}
+	s := currentStorage()
+	if ok, reason := s.healthy(); !ok {
+		status = componentHealth{Status: statusFail, Detail: fmt.Sprintf("storage %s: %s", s.Name, reason)}
+	}
+	if atomic.LoadInt32(&ready) == 0 {
+		status = componentHealth{Status: statusFail, Detail: "starting"}
+	}
+	writeHealth(w, status.Status != statusOK, status)
+}
+
+func writeHealth(w http.ResponseWriter, failed bool, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Printf("health: error encoding response: %s", err)
+	}
+}
+
+// publicHealth serves the health endpoints without authentication.
+func publicHealth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			noCache(http.HandlerFunc(healthz)).ServeHTTP(w, r)
+		case "/readyz":
+			noCache(http.HandlerFunc(readyz)).ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
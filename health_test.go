@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCamerasHealthDefaultDuration leaves the duration out of the config,
+// the default one is used for the staleness.
+func TestCamerasHealthDefaultDuration(t *testing.T) {
+	prevConfig, prevDuration, prevFFMPEG := config, duration, ffmpeg
+	prevStorages, prevStorage := storages, activeStorage
+	defer func() {
+		config, duration, ffmpeg = prevConfig, prevDuration, prevFFMPEG
+		storages, activeStorage = prevStorages, prevStorage
+	}()
+	config = &Config{}
+	loadDefaults()
+
+	name := "health-default-duration"
+	cameraByName[name] = &Camera{Name: name}
+	defer delete(cameraByName, name)
+	st := cameraStateOf(name)
+	st.transition(camRecording)
+	st.mu.Lock()
+	st.lastSegment = time.Now().Add(-time.Minute * 20)
+	st.mu.Unlock()
+
+	for _, h := range camerasHealth() {
+		if h.Name == name && h.Status != statusOK {
+			t.Errorf("segment from 20 minutes ago: got %s, want %s", h.Status, statusOK)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = time.Minute * 5
+	defaultHeartbeatTimeout  = time.Second * 30
+)
+
+// Heartbeat pings an external monitor, like healthchecks.io.
+type Heartbeat struct {
+	URL      string        `yaml:"url"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// GET sends no payload
+	Method string `yaml:"method"`
+	// pinged once when starting
+	StartURL string `yaml:"start_url"`
+	// pinged instead of url when something is unhealthy, url is not
+	// pinged at all when empty
+	FailURL string `yaml:"fail_url"`
+}
+
+type heartbeatPayload struct {
+	Status   string            `json:"status"`
+	Problems []string          `json:"problems"`
+	Version  string            `json:"version"`
+	Started  time.Time         `json:"started"`
+	Uptime   float64           `json:"uptime"`
+	Cameras  []heartbeatCamera `json:"cameras"`
+	Storage  []storageInfo     `json:"storage"`
+	Disks    []diskHealth      `json:"disks"`
+	System   systemInfo        `json:"system"`
+}
+
+type heartbeatCamera struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+}
+
+// healthProblems lists what keeps the system unhealthy, empty when
+// everything is fine.
+func healthProblems() []string {
+	var problems []string
+	s := currentStorage()
+	if ok, reason := s.healthy(); !ok {
+		problems = append(problems, fmt.Sprintf("storage %s: %s", s.Name, reason))
+	}
+	if !s.diskHealthy() {
+		problems = append(problems, fmt.Sprintf("disk of %s is failing", s.Name))
+	}
+	for _, c := range heartbeatCameras() {
+		if !c.Healthy {
+			problems = append(problems, fmt.Sprintf("camera %s is unhealthy", c.Name))
+		}
+	}
+	return problems
+}
+
+func heartbeatCameras() []heartbeatCamera {
+	cameras := []heartbeatCamera{}
+	for name, c := range cameraByName {
+		cameras = append(cameras, heartbeatCamera{Name: name, Healthy: c.state().ok()})
+	}
+	sort.Slice(cameras, func(i, j int) bool {
+		return cameras[i].Name < cameras[j].Name
+	})
+	return cameras
+}
+
+func newHeartbeatPayload() heartbeatPayload {
+	p := heartbeatPayload{
+		Status:   "ok",
+		Problems: healthProblems(),
+		Version:  version,
+		Started:  started,
+		Uptime:   time.Since(started).Seconds(),
+		Cameras:  heartbeatCameras(),
+		Storage:  storagesStatus(),
+		Disks:    disksHealth(),
+		System:   currentSystem(),
+	}
+	if len(p.Problems) > 0 {
+		p.Status = "fail"
+	} else {
+		p.Problems = []string{}
+	}
+	return p
+}
+
+// heartbeat pings the monitor every interval, errors are logged and the
+// next ping is tried anyway.
+func heartbeat() {
+	hb := config.Heartbeat
+	if hb.URL == "" {
+		// legacy config, GET when healthy
+		hb.URL = config.HealthCheckURL
+	}
+	if hb.Interval <= 0 {
+		hb.Interval = defaultHeartbeatInterval
+	}
+	if hb.Timeout <= 0 {
+		hb.Timeout = defaultHeartbeatTimeout
+	}
+	hb.Method = strings.ToUpper(hb.Method)
+	if hb.Method == "" {
+		hb.Method = http.MethodGet
+	}
+	client := &http.Client{Timeout: hb.Timeout}
+
+	logger.Printf("heartbeat enabled, every %s", hb.Interval)
+
+	if hb.StartURL != "" {
+		if err := hb.ping(client, hb.StartURL, newHeartbeatPayload()); err != nil {
+			logger.Printf("heartbeat: error on start ping: %s", err)
+		}
+	}
+
+	var lastErr string
+	for range time.NewTicker(hb.Interval).C {
+		p := newHeartbeatPayload()
+		url := hb.URL
+		if p.Status != "ok" {
+			if hb.FailURL == "" {
+				if config.Debug {
+					logger.Printf("heartbeat: skipped, %s", strings.Join(p.Problems, ", "))
+				}
+				continue
+			}
+			url = hb.FailURL
+		}
+
+		err := hb.ping(client, url, p)
+		switch {
+		case err != nil:
+			// logged once while failing the same way
+			if err.Error() != lastErr {
+				logger.Printf("heartbeat: %s", err)
+			}
+			lastErr = err.Error()
+		case lastErr != "":
+			logger.Printf("heartbeat: pinging again")
+			lastErr = ""
+		}
+	}
+}
+
+func (hb Heartbeat) ping(client *http.Client, url string, p heartbeatPayload) error {
+	var body io.Reader
+	if hb.Method != http.MethodGet && hb.Method != http.MethodHead {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(hb.Method, url, body)
+	if err != nil {
+		return fmt.Errorf("invalid url %s: %s", url, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", "vigilantpi/"+version)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", hb.Method, url, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+	"vigilantpi/db"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultHANodeID           = "vigilantpi"
+	defaultHADiscoveryPrefix  = "homeassistant"
+	defaultHAInterval         = time.Minute
+	defaultHASnapshotInterval = time.Minute * 15
+	defaultHAMotionTimeout    = time.Second * 30
+	haQueueSize               = 50
+
+	haCmdArmed    = "armed"
+	haCmdSnapshot = "snapshot"
+	haCmdRestart  = "restart"
+	haCmdTasks    = "tasks"
+)
+
+// accepted when commands isn't set
+var defaultHACommands = []string{haCmdArmed, haCmdSnapshot}
+
+// HomeAssistant publishes cameras, motion, storages and snapshots to an
+// mqtt broker, with home assistant discovery.
+type HomeAssistant struct {
+	// broker, like tcp://192.168.1.10:1883
+	URL      string `yaml:"url"`
+	User     string `yaml:"user"`
+	Pass     string `yaml:"pass"`
+	ClientID string `yaml:"client_id"`
+	// accepted commands: armed, snapshot, restart and tasks. armed and
+	// snapshot when not set, an empty list disables them
+	Commands []string `yaml:"commands"`
+	// unique per vigilantpi on the same home assistant
+	NodeID string `yaml:"node_id"`
+	// base topic, the node id when empty
+	Topic           string `yaml:"topic"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	// how often states and disk usage are published
+	Interval time.Duration `yaml:"interval"`
+	// how often snapshots of the recording cameras are published,
+	// negative to publish only on motion and when requested
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+	// how long motion sensors stay on
+	MotionTimeout time.Duration `yaml:"motion_timeout"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+type haMessage struct {
+	topic    string
+	retained bool
+	payload  interface{}
+}
+
+type homeAssistant struct {
+	HomeAssistant
+	client mqtt.Client
+	queue  chan haMessage
+}
+
+// set once on startHomeAssistant, hooks do nothing while nil
+var ha *homeAssistant
+
+var slugRe = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// slug is used on topics and entity ids.
+func slug(name string) string {
+	return strings.Trim(slugRe.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "_"), "_")
+}
+
+// armed tells if motion is notified, it's still recorded and published
+// when disarmed.
+func armed() bool {
+	return db.Get("disarmed") == ""
+}
+
+func setArmed(on bool) {
+	var err error
+	if on {
+		err = db.Del("disarmed")
+	} else {
+		err = db.Set("disarmed", "1")
+	}
+	if err != nil {
+		logger.Printf("error saving armed state: %s", err)
+	}
+}
+
+// startHomeAssistant connects to the broker, the cameras must be
+// registered already.
+func startHomeAssistant() {
+	cfg := config.HomeAssistant
+	if cfg.NodeID == "" {
+		cfg.NodeID = defaultHANodeID
+	}
+	cfg.NodeID = slug(cfg.NodeID)
+	if cfg.Topic == "" {
+		cfg.Topic = cfg.NodeID
+	}
+	cfg.Topic = strings.TrimSuffix(cfg.Topic, "/")
+	if cfg.DiscoveryPrefix == "" {
+		cfg.DiscoveryPrefix = defaultHADiscoveryPrefix
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultHAInterval
+	}
+	if cfg.SnapshotInterval == 0 {
+		cfg.SnapshotInterval = defaultHASnapshotInterval
+	}
+	if cfg.MotionTimeout <= 0 {
+		cfg.MotionTimeout = defaultHAMotionTimeout
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultNotifierTimeout
+	}
+	if cfg.Commands == nil {
+		cfg.Commands = defaultHACommands
+	}
+	for _, cmd := range cfg.Commands {
+		if !contains([]string{haCmdArmed, haCmdSnapshot, haCmdRestart, haCmdTasks}, cmd) {
+			logger.Printf("home assistant: unknown command %s", cmd)
+		}
+	}
+
+	h := &homeAssistant{HomeAssistant: cfg, queue: make(chan haMessage, haQueueSize)}
+	h.client = mqttConnect(cfg.URL, mqttClientID(cfg.ClientID, "ha"), cfg.User, cfg.Pass, cfg.Timeout, h.topic("status"), h.connected)
+	ha = h
+
+	go h.publisher()
+	go func() {
+		for range time.NewTicker(cfg.Interval).C {
+			h.publishStates()
+		}
+	}()
+	if cfg.SnapshotInterval > 0 {
+		go func() {
+			for range time.NewTicker(cfg.SnapshotInterval).C {
+				h.publishSnapshots()
+			}
+		}()
+	}
+}
+
+func (h *homeAssistant) topic(parts ...string) string {
+	return h.Topic + "/" + strings.Join(parts, "/")
+}
+
+// connected runs on every connection, the broker may have lost the
+// retained messages and the subscriptions.
+func (h *homeAssistant) connected(c mqtt.Client) {
+	h.publish(h.topic("status"), true, "online")
+	h.publishDiscovery()
+	h.publishStates()
+
+	subs := map[string]mqtt.MessageHandler{}
+	if h.accepts(haCmdArmed) {
+		subs[h.topic("armed", "set")] = h.armCmd
+	}
+	if h.accepts(haCmdSnapshot) {
+		subs[h.topic("camera", "+", "snapshot", "take")] = h.snapshotCmd
+	}
+	if h.accepts(haCmdRestart) {
+		subs[h.topic("restart")] = h.restartCmd
+	}
+	if h.accepts(haCmdTasks) {
+		subs[h.topic("task", "+", "run")] = h.taskCmd
+	}
+	for topic, handler := range subs {
+		t := c.Subscribe(topic, 1, handler)
+		switch {
+		case !t.WaitTimeout(h.Timeout):
+			logger.Printf("home assistant: timeout subscribing to %s", topic)
+		case t.Error() != nil:
+			logger.Printf("home assistant: error subscribing to %s: %s", topic, t.Error())
+		}
+	}
+}
+
+func (h *homeAssistant) accepts(cmd string) bool {
+	return contains(h.Commands, cmd)
+}
+
+func (h *homeAssistant) publish(topic string, retained bool, payload interface{}) {
+	if err := mqttPublish(h.client, topic, retained, payload, h.Timeout); err != nil {
+		logger.Printf("home assistant: %s", err)
+	}
+}
+
+// enqueue publishes in background, keeping the order.
+func (h *homeAssistant) enqueue(topic string, retained bool, payload interface{}) {
+	select {
+	case h.queue <- haMessage{topic, retained, payload}:
+	default:
+		logger.Printf("home assistant: queue is full, can't publish to %s", topic)
+	}
+}
+
+func (h *homeAssistant) publisher() {
+	for m := range h.queue {
+		h.publish(m.topic, m.retained, m.payload)
+	}
+}
+
+func (h *homeAssistant) publishDiscovery() {
+	availability := []map[string]string{{"topic": h.topic("status")}}
+	hub := map[string]interface{}{
+		"identifiers":  []string{h.NodeID},
+		"name":         "VigilantPI",
+		"manufacturer": "VigilantPI",
+		"sw_version":   version,
+	}
+	configTopic := func(component, id string) string {
+		return fmt.Sprintf("%s/%s/%s/%s/config", h.DiscoveryPrefix, component, h.NodeID, id)
+	}
+	// entities of disabled commands are removed, they may have been
+	// published before
+	remove := func(component, id string) {
+		h.publish(configTopic(component, id), true, "")
+	}
+	entity := func(component, id string, device map[string]interface{}, fields map[string]interface{}) {
+		fields["unique_id"] = h.NodeID + "_" + id
+		fields["object_id"] = h.NodeID + "_" + id
+		fields["device"] = device
+		fields["availability"] = availability
+		h.publish(configTopic(component, id), true, fields)
+	}
+
+	// read only without the command
+	if h.accepts(haCmdArmed) {
+		remove("binary_sensor", "armed")
+		entity("switch", "armed", hub, map[string]interface{}{
+			"name":          "Armed",
+			"icon":          "mdi:shield-home",
+			"state_topic":   h.topic("armed"),
+			"command_topic": h.topic("armed", "set"),
+		})
+	} else {
+		remove("switch", "armed")
+		entity("binary_sensor", "armed", hub, map[string]interface{}{
+			"name":        "Armed",
+			"icon":        "mdi:shield-home",
+			"state_topic": h.topic("armed"),
+		})
+	}
+	if h.accepts(haCmdRestart) {
+		entity("button", "restart", hub, map[string]interface{}{
+			"name":          "Restart",
+			"device_class":  "restart",
+			"command_topic": h.topic("restart"),
+		})
+	} else {
+		remove("button", "restart")
+	}
+	for _, t := range config.Tasks {
+		id := slug(t.Name)
+		if !h.accepts(haCmdTasks) {
+			remove("button", "task_"+id)
+			continue
+		}
+		entity("button", "task_"+id, hub, map[string]interface{}{
+			"name":          "Run " + t.Name,
+			"icon":          "mdi:cog-play",
+			"command_topic": h.topic("task", id, "run"),
+		})
+	}
+	for _, s := range storages {
+		id := slug(s.Name)
+		entity("sensor", "storage_"+id+"_usage", hub, map[string]interface{}{
+			"name":                  "Storage " + s.Name + " usage",
+			"icon":                  "mdi:harddisk",
+			"unit_of_measurement":   "%",
+			"state_class":           "measurement",
+			"state_topic":           h.topic("storage", id),
+			"value_template":        "{{ value_json.used_percent }}",
+			"json_attributes_topic": h.topic("storage", id),
+		})
+		entity("sensor", "storage_"+id+"_free", hub, map[string]interface{}{
+			"name":                          "Storage " + s.Name + " free",
+			"device_class":                  "data_size",
+			"unit_of_measurement":           "B",
+			"suggested_unit_of_measurement": "GB",
+			"state_class":                   "measurement",
+			"state_topic":                   h.topic("storage", id),
+			"value_template":                "{{ value_json.free }}",
+		})
+	}
+
+	for _, c := range config.Cameras {
+		id := slug(c.Name)
+		device := map[string]interface{}{
+			"identifiers": []string{h.NodeID + "_" + id},
+			"name":        strings.TrimSpace(c.Name),
+			"via_device":  h.NodeID,
+		}
+		entity("binary_sensor", id+"_online", device, map[string]interface{}{
+			"name":         "Online",
+			"device_class": "connectivity",
+			"state_topic":  h.topic("camera", id, "available"),
+			"payload_on":   "online",
+			"payload_off":  "offline",
+		})
+		entity("sensor", id+"_state", device, map[string]interface{}{
+			"name":                  "State",
+			"device_class":          "enum",
+			"options":               []string{camStarting, camRecording, camReconnecting, camFailing, camDisabled, camIdle},
+			"state_topic":           h.topic("camera", id, "status"),
+			"value_template":        "{{ value_json.state }}",
+			"json_attributes_topic": h.topic("camera", id, "status"),
+		})
+		entity("binary_sensor", id+"_motion", device, map[string]interface{}{
+			"name":         "Motion",
+			"device_class": "motion",
+			"state_topic":  h.topic("camera", id, "motion"),
+			"off_delay":    int(h.MotionTimeout.Seconds()),
+		})
+		entity("camera", id, device, map[string]interface{}{
+			"name":  "Snapshot",
+			"topic": h.topic("camera", id, "snapshot"),
+		})
+		if h.accepts(haCmdSnapshot) {
+			entity("button", id+"_take_snapshot", device, map[string]interface{}{
+				"name":          "Take snapshot",
+				"icon":          "mdi:camera",
+				"command_topic": h.topic("camera", id, "snapshot", "take"),
+			})
+		} else {
+			remove("button", id+"_take_snapshot")
+		}
+	}
+}
+
+func (h *homeAssistant) publishStates() {
+	h.publish(h.topic("armed"), true, onOff(armed()))
+	for _, st := range camerasStatus() {
+		h.publishCamera(st, h.publish)
+	}
+	for _, s := range storagesStatus() {
+		var used float64
+		if s.Total > 0 {
+			used = float64(int(1000*float64(s.Total-s.Free)/float64(s.Total))) / 10
+		}
+		h.publish(h.topic("storage", slug(s.Name)), true, map[string]interface{}{
+			"used_percent": used,
+			"free":         s.Free,
+			"total":        s.Total,
+			"active":       s.Active,
+			"healthy":      s.Healthy,
+			"reason":       s.Reason,
+		})
+	}
+}
+
+func (h *homeAssistant) publishCamera(st cameraStatus, publish func(string, bool, interface{})) {
+	id := slug(st.Name)
+	available := "offline"
+	if st.State == camRecording {
+		available = "online"
+	}
+	publish(h.topic("camera", id, "available"), true, available)
+	publish(h.topic("camera", id, "status"), true, st)
+}
+
+func (h *homeAssistant) publishSnapshots() {
+	for _, st := range camerasStatus() {
+		if st.State != camRecording {
+			continue
+		}
+		if c, ok := cameraByName[st.Name]; ok {
+			h.publishSnapshot(c, c.Preview)
+		}
+	}
+}
+
+func (h *homeAssistant) publishSnapshot(c *Camera, take func() (string, func() error, error)) {
+	file, rm, err := take()
+	if err != nil {
+		logger.Printf("home assistant: error taking snapshot of %s: %s", c.Name, err)
+		return
+	}
+	defer rm()
+	h.publishImage(c.Name, file)
+}
+
+func (h *homeAssistant) publishImage(camera, file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		logger.Printf("home assistant: error reading snapshot of %s: %s", camera, err)
+		return
+	}
+	h.publish(h.topic("camera", slug(camera), "snapshot"), true, data)
+}
+
+func (h *homeAssistant) armCmd(_ mqtt.Client, m mqtt.Message) {
+	on := strings.EqualFold(string(m.Payload()), "ON")
+	if on {
+		logger.Printf("home assistant: armed")
+	} else {
+		logger.Printf("home assistant: disarmed, motion won't be notified")
+	}
+	setArmed(on)
+	h.enqueue(h.topic("armed"), true, onOff(on))
+}
+
+func (h *homeAssistant) restartCmd(_ mqtt.Client, m mqtt.Message) {
+	logger.Printf("home assistant: restart requested")
+	db.Del("pause")
+	go func() {
+		time.Sleep(time.Second)
+		restart()
+	}()
+}
+
+// topicPart is the + of the subscription, counted from the end.
+func topicPart(topic string, fromEnd int) string {
+	parts := strings.Split(topic, "/")
+	if len(parts) <= fromEnd {
+		return ""
+	}
+	return parts[len(parts)-1-fromEnd]
+}
+
+func (h *homeAssistant) snapshotCmd(_ mqtt.Client, m mqtt.Message) {
+	id := topicPart(m.Topic(), 2)
+	for name, c := range cameraByName {
+		if slug(name) == id {
+			go h.publishSnapshot(c, c.Snapshot)
+			return
+		}
+	}
+	logger.Printf("home assistant: snapshot of unknown camera %s", id)
+}
+
+func (h *homeAssistant) taskCmd(_ mqtt.Client, m mqtt.Message) {
+	id := topicPart(m.Topic(), 1)
+	for _, t := range config.Tasks {
+		if slug(t.Name) != id {
+			continue
+		}
+		t := t
+		go func() {
+			logger.Printf("home assistant: running task %s", t.Name)
+			out, err := t.run(nil)
+			result := map[string]interface{}{"output": out, "time": time.Now()}
+			if err != nil {
+				result["error"] = err.Error()
+			}
+			h.enqueue(h.topic("task", id, "result"), false, result)
+		}()
+		return
+	}
+	logger.Printf("home assistant: unknown task %s", id)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// haCameraChanged publishes a camera state change.
+func haCameraChanged(name string) {
+	if h := ha; h != nil {
+		h.publishCamera(cameraStateOf(name).status(), h.enqueue)
+	}
+}
+
+// haMotion turns the motion sensor of the camera on, with the image
+// that triggered it as snapshot.
+func haMotion(camera, image string) {
+	h := ha
+	if h == nil {
+		return
+	}
+	h.enqueue(h.topic("camera", slug(camera), "motion"), false, "ON")
+	if data, err := ioutil.ReadFile(image); err == nil {
+		h.enqueue(h.topic("camera", slug(camera), "snapshot"), true, data)
+	}
+}
+
+// haStop marks vigilantpi offline before exiting.
+func haStop() {
+	h := ha
+	if h == nil {
+		return
+	}
+	h.publish(h.topic("status"), true, "offline")
+	h.client.Disconnect(250)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	indexFileName = "index.json"
+	indexLockName = ".index.lock"
+
+	jobReindex = "reindex"
+
+	// files changed more recently may still be being written
+	reindexMinAge = time.Minute
+)
+
+// dayIndex is kept on each day directory as index.json.
+type dayIndex struct {
+	Day        string       `json:"day"`
+	Recordings []indexEntry `json:"recordings"`
+}
+
+type indexEntry struct {
+	File      string    `json:"file"`
+	Camera    string    `json:"camera"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Duration  float64   `json:"duration"`
+	Size      int64     `json:"size"`
+	Codec     string    `json:"codec,omitempty"`
+	Width     int       `json:"width,omitempty"`
+	Height    int       `json:"height,omitempty"`
+	Motion    int       `json:"motion"`
+	Protected bool      `json:"protected"`
+	Timelapse bool      `json:"timelapse,omitempty"`
+
+	// integrity check, Verified is zero when only probed
+	OK       bool      `json:"ok"`
+	Repaired bool      `json:"repaired,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Verified time.Time `json:"verified"`
+}
+
+type videoInfo struct {
+	Duration float64
+	Codec    string
+	Width    int
+	Height   int
+}
+
+// serializes read-modify-write of the indexes
+var indexMu sync.Mutex
+
+// lockIndexes also takes a flock on the videos dir, the command line
+// tools (fsck, reindex) may run along with the daemon.
+func lockIndexes(dir string) (unlock func(), err error) {
+	indexMu.Lock()
+	f, err := os.OpenFile(path.Join(dir, indexLockName), os.O_CREATE|os.O_RDWR, 0664)
+	if err != nil {
+		indexMu.Unlock()
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		indexMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		indexMu.Unlock()
+	}, nil
+}
+
+func indexPath(dir, dayDir string) string {
+	return path.Join(dir, dayDir, indexFileName)
+}
+
+// probeVideo reads the duration and the first video stream of a file.
+func probeVideo(file string) (videoInfo, error) {
+	var info videoInfo
+	out, err := exec.Command(
+		ffprobePath(),
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "format=duration:stream=codec_name,width,height",
+		"-of", "json",
+		file,
+	).Output()
+	if err != nil {
+		return info, fmt.Errorf("ffprobe: %s", err)
+	}
+
+	var res struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return info, fmt.Errorf("ffprobe: %s", err)
+	}
+	if len(res.Streams) > 0 {
+		info.Codec = res.Streams[0].CodecName
+		info.Width = res.Streams[0].Width
+		info.Height = res.Streams[0].Height
+	}
+	if info.Duration, err = strconv.ParseFloat(res.Format.Duration, 64); err != nil {
+		return info, fmt.Errorf("invalid duration %q", res.Format.Duration)
+	}
+	return info, nil
+}
+
+// newIndexEntry describes a recording with the probed info.
+func newIndexEntry(rec recording, info videoInfo) indexEntry {
+	e := indexEntry{
+		File:      path.Base(rec.rel),
+		Camera:    rec.camera,
+		Start:     rec.start,
+		End:       rec.end,
+		Duration:  info.Duration,
+		Codec:     info.Codec,
+		Width:     info.Width,
+		Height:    info.Height,
+		Timelapse: rec.timelapse,
+	}
+	if stat, err := os.Stat(rec.path); err == nil {
+		e.Size = stat.Size()
+	}
+	if info.Duration > 0 && !rec.timelapse {
+		e.End = rec.start.Add(time.Duration(info.Duration * float64(time.Second)))
+	}
+
+	rec.end = e.End
+	e.Protected = isProtected(rec)
+	if !rec.timelapse {
+		for _, t := range motionEvents()[rec.camera] {
+			if !t.Before(e.Start) && t.Before(e.End) {
+				e.Motion++
+			}
+		}
+	}
+	return e
+}
+
+// recording returns the recording described by the entry.
+func (e indexEntry) recording(dir, dayDir string) recording {
+	return recording{
+		path:      path.Join(dir, dayDir, e.File),
+		rel:       path.Join(dayDir, e.File),
+		camera:    e.Camera,
+		start:     e.Start,
+		end:       e.End,
+		size:      e.Size,
+		timelapse: e.Timelapse,
+		duration:  e.Duration,
+		codec:     e.Codec,
+		width:     e.Width,
+		height:    e.Height,
+		motion:    e.Motion,
+	}
+}
+
+func readDayIndex(dir, dayDir string) (*dayIndex, error) {
+	idx := &dayIndex{Day: dayDir}
+	data, err := ioutil.ReadFile(indexPath(dir, dayDir))
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, idx); err != nil {
+		logger.Printf("index: %s is corrupted, starting over: %s", indexPath(dir, dayDir), err)
+		return &dayIndex{Day: dayDir}, nil
+	}
+	return idx, nil
+}
+
+// updateDayIndex runs fn over the index of a day of dir and saves it.
+func updateDayIndex(dir, dayDir string, fn func(idx *dayIndex)) error {
+	unlock, err := lockIndexes(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	idx, err := readDayIndex(dir, dayDir)
+	if err != nil {
+		return err
+	}
+	fn(idx)
+	sort.Slice(idx.Recordings, func(i, j int) bool {
+		return idx.Recordings[i].File < idx.Recordings[j].File
+	})
+
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(indexPath(dir, dayDir), data)
+}
+
+// entry returns the entry of a file, adding it when missing.
+func (idx *dayIndex) entry(file string) *indexEntry {
+	for i := range idx.Recordings {
+		if idx.Recordings[i].File == file {
+			return &idx.Recordings[i]
+		}
+	}
+	idx.Recordings = append(idx.Recordings, indexEntry{File: file})
+	return &idx.Recordings[len(idx.Recordings)-1]
+}
+
+func (idx *dayIndex) find(file string) (indexEntry, bool) {
+	for _, e := range idx.Recordings {
+		if e.File == file {
+			return e, true
+		}
+	}
+	return indexEntry{}, false
+}
+
+func removeFromIndex(rec recording) {
+	dir, dayDir, file := rec.dir(), path.Dir(rec.rel), path.Base(rec.rel)
+	if _, err := os.Stat(indexPath(dir, dayDir)); os.IsNotExist(err) {
+		return
+	}
+	err := updateDayIndex(dir, dayDir, func(idx *dayIndex) {
+		for i := range idx.Recordings {
+			if idx.Recordings[i].File == file {
+				idx.Recordings = append(idx.Recordings[:i], idx.Recordings[i+1:]...)
+				return
+			}
+		}
+	})
+	if err != nil {
+		logger.Printf("index: error removing %s: %s", rec.rel, err)
+	}
+}
+
+// reindexDay probes the recordings of a day missing on its index, or
+// every recording when full is set. Integrity results are kept while
+// the file size doesn't change.
+func reindexDay(dayDir string, full bool) (int, error) {
+	files, err := ioutil.ReadDir(path.Join(videosDir(), dayDir))
+	if err != nil {
+		return 0, err
+	}
+	old, err := readDayIndex(videosDir(), dayDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []indexEntry
+	present := make(map[string]bool)
+	for _, f := range files {
+		rec, ok := parseRecording(dayDir, f.Name())
+		if f.IsDir() || !ok {
+			continue
+		}
+		present[f.Name()] = true
+		prev, indexed := old.find(f.Name())
+		if indexed && !full {
+			continue
+		}
+		if !full && time.Since(f.ModTime()) < reindexMinAge {
+			continue
+		}
+
+		info, err := probeVideo(rec.path)
+		e := newIndexEntry(rec, info)
+		if indexed && !prev.Verified.IsZero() && prev.Size == e.Size {
+			e.OK, e.Repaired, e.Error, e.Verified = prev.OK, prev.Repaired, prev.Error, prev.Verified
+		} else {
+			e.OK = err == nil
+			if err != nil {
+				e.Error = err.Error()
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	err = updateDayIndex(videosDir(), dayDir, func(idx *dayIndex) {
+		kept := idx.Recordings[:0]
+		for _, e := range idx.Recordings {
+			if present[e.File] {
+				kept = append(kept, e)
+			}
+		}
+		idx.Recordings = kept
+		for _, e := range entries {
+			*idx.entry(e.File) = e
+		}
+	})
+	return len(entries), err
+}
+
+// queueReindex queues the days with recordings not indexed yet.
+func queueReindex() {
+	days, err := listDays()
+	if err != nil {
+		logger.Printf("index: error listing days: %s", err)
+		return
+	}
+	for _, day := range days {
+		if _, err := os.Stat(indexPath(videosDir(), day)); os.IsNotExist(err) {
+			enqueue(jobReindex, path.Join(videosDir(), day), priorityLow)
+		}
+	}
+}
+
+// refreshProtectedIndex updates the protected flag of every indexed
+// recording, called when protections change.
+func refreshProtectedIndex() {
+	days, err := listDays()
+	if err != nil {
+		return
+	}
+	for _, day := range days {
+		if _, err := os.Stat(indexPath(videosDir(), day)); err != nil {
+			continue
+		}
+		err := updateDayIndex(videosDir(), day, func(idx *dayIndex) {
+			for i, e := range idx.Recordings {
+				idx.Recordings[i].Protected = isProtected(e.recording(videosDir(), day))
+			}
+		})
+		if err != nil {
+			logger.Printf("index: error updating %s: %s", day, err)
+		}
+	}
+}
+
+func reindexCmd(args []string) error {
+	days := args
+	if len(days) == 0 {
+		var err error
+		if days, err = listDays(); err != nil {
+			return err
+		}
+	}
+	for _, day := range days {
+		n, err := reindexDay(cleanRel(day), true)
+		if err != nil {
+			return fmt.Errorf("%s: %s", day, err)
+		}
+		fmt.Printf("%s: %d recordings\n", day, n)
+	}
+	return nil
+}
+
+// writeFileAtomic writes to a hidden temporary file on the same dir and
+// renames it, a crash leaves either the previous or the new content.
+func writeFileAtomic(file string, data []byte) error {
+	f, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := f.Chmod(0664); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
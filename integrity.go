@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// a few decoding errors are common on recordings that play fine
+const maxDecodeErrors = 20
+
+// verifyVideo checks the duration of a video and that its keyframes can
+// be decoded. Decoding every frame would take too long on the pi.
+// A video is damaged when ffmpeg fails or reports too many errors.
+func verifyVideo(file string) (videoInfo, error) {
+	info, err := probeVideo(file)
+	if err != nil {
+		return info, fmt.Errorf("can't read duration: %s", err)
+	}
+	if info.Duration <= 0 {
+		return info, fmt.Errorf("invalid duration %.3f", info.Duration)
+	}
+
+	out, err := exec.Command(
+		ffmpeg,
+		"-nostdin", "-v", "error",
+		"-skip_frame", "nokey",
+		"-i", file,
+		"-map", "0:v",
+		"-f", "null", "-",
+	).CombinedOutput()
+	if err != nil {
+		return info, fmt.Errorf("%s: %s", err, lastLines(string(out), 3))
+	}
+	msg := strings.TrimSpace(string(out))
+	if n := strings.Count(msg, "\n") + 1; msg != "" && n > maxDecodeErrors {
+		return info, fmt.Errorf("%d decoding errors: %s", n, lastLines(msg, 3))
+	}
+	return info, nil
+}
+
+// repairVideo remuxes a video dropping corrupted packets and regenerating
+// timestamps, which fixes most files truncated by power cuts.
+func repairVideo(file string) error {
+	tmpDir := path.Join(storageOf(file).VideosDir, ".tmp")
+	if err := os.MkdirAll(tmpDir, 0774); err != nil {
+		return err
+	}
+	tmp := path.Join(tmpDir, "repair_"+path.Base(file))
+	args := []string{
+		"-nostdin", "-y", "-v", "error",
+		"-err_detect", "ignore_err",
+		"-fflags", "+genpts+discardcorrupt",
+		"-i", file,
+		"-map", "0", "-c", "copy",
+	}
+	if strings.EqualFold(filepath.Ext(file), ".mp4") {
+		args = append(args, "-movflags", "+faststart")
+	}
+	out, err := exec.Command(ffmpeg, append(args, tmp)...).CombinedOutput()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %s", err, lastLines(string(out), 3))
+	}
+	if info, err := os.Stat(tmp); err != nil || info.Size() == 0 {
+		os.Remove(tmp)
+		return errors.New("nothing could be recovered")
+	}
+	return moveFile(tmp, file)
+}
+
+// verifyRecording checks a converted recording, repairing it when damaged,
+// and saves the result on its day index. Protected recordings are only
+// reported, they are kept as they are.
+func verifyRecording(file string) indexEntry {
+	dayDir, name := path.Base(path.Dir(file)), path.Base(file)
+	rec, ok := parseRecording(dayDir, name)
+	if !ok {
+		rec = recording{rel: path.Join(dayDir, name)}
+	}
+	// the index is updated on the storage of the file
+	rec.path = file
+
+	var repaired bool
+	info, err := verifyVideo(file)
+	switch {
+	case err == nil:
+	case isProtected(rec):
+		logger.Printf("integrity: %s is damaged, not repairing a protected recording: %s", file, err)
+		err = fmt.Errorf("%s (protected, not repaired)", err)
+	default:
+		logger.Printf("integrity: %s is damaged, repairing: %s", file, err)
+		if rerr := repairVideo(file); rerr != nil {
+			err = fmt.Errorf("%s (repair failed: %s)", err, rerr)
+		} else {
+			repaired = true
+			info, err = verifyVideo(file)
+		}
+	}
+
+	entry := newIndexEntry(rec, info)
+	entry.Verified = time.Now()
+	entry.Repaired = repaired
+	entry.OK = err == nil
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	uerr := updateDayIndex(rec.dir(), dayDir, func(idx *dayIndex) {
+		*idx.entry(entry.File) = entry
+	})
+	if uerr != nil {
+		logger.Printf("integrity: error updating index of %s: %s", dayDir, uerr)
+	}
+	return entry
+}
+
+type fsckReport struct {
+	Checked  int
+	Repaired []string
+	Damaged  []string
+}
+
+func (r fsckReport) String() string {
+	s := fmt.Sprintf("%d recordings checked, %d repaired, %d damaged", r.Checked, len(r.Repaired), len(r.Damaged))
+	for _, rel := range r.Damaged {
+		s += "\n- " + rel
+	}
+	return s
+}
+
+// fsck verifies every recording on the videos dir, or only on days.
+func fsck(days []string, progress func(rel string, entry indexEntry)) (fsckReport, error) {
+	var report fsckReport
+	recs, err := listRecordings(videosDir())
+	if err != nil {
+		return report, err
+	}
+
+	for _, rec := range recs {
+		if len(days) > 0 && !contains(days, path.Dir(rec.rel)) {
+			continue
+		}
+		entry := verifyRecording(rec.path)
+		report.Checked++
+		if entry.Repaired && entry.OK {
+			report.Repaired = append(report.Repaired, rec.rel)
+		}
+		if !entry.OK {
+			report.Damaged = append(report.Damaged, rec.rel)
+		}
+		if progress != nil {
+			progress(rec.rel, entry)
+		}
+	}
+	return report, nil
+}
+
+func fsckCmd(args []string) error {
+	report, err := fsck(args, func(rel string, entry indexEntry) {
+		switch {
+		case !entry.OK:
+			fmt.Printf("DAMAGED  %s: %s\n", rel, entry.Error)
+		case entry.Repaired:
+			fmt.Printf("REPAIRED %s\n", rel)
+		default:
+			fmt.Printf("ok       %s\n", rel)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	if len(report.Damaged) > 0 {
+		return fmt.Errorf("%d damaged recordings", len(report.Damaged))
+	}
+	return nil
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -23,10 +23,6 @@ var (
 	logger *log.Logger
 
 	configPath string
-	videosDir  string
-	mountedDir string
-	mountDev   string
-	mountLabel string
 
 	duration time.Duration
 
@@ -73,6 +69,52 @@ func main() {
 			loadConfig()
 			fmt.Println(config.MountDir)
 			return
+
+		case "export":
+			logger = log.New(os.Stderr, "", log.LstdFlags)
+			loadConfig()
+			loadDefaults()
+			selectStorage()
+			if err := exportCmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+
+		case "reindex":
+			logger = log.New(os.Stderr, "", log.LstdFlags)
+			loadConfig()
+			loadDefaults()
+			selectStorage()
+			// protections and motion events are read from the db
+			initDB()
+			if err := reindexCmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+
+		case "fsck":
+			logger = log.New(os.Stderr, "", log.LstdFlags)
+			loadConfig()
+			loadDefaults()
+			selectStorage()
+			// protections and motion events are read from the db
+			initDB()
+			if err := fsckCmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+
+		case "notify":
+			logger = log.New(os.Stderr, "", log.LstdFlags)
+			loadConfig()
+			if err := notifyCmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
 		}
 	}
 
@@ -91,32 +133,20 @@ func main() {
 
 	loadConfig()
 
+	// the admin, telegram and home assistant handlers read the cameras from
+	// the start, before run() is called
+	indexCameras(config.Cameras)
+
 	config.Tasks.Init()
 	registerBuiltinTasks()
 
+	startRelays()
+
 	go httpServer(config.Admin.Addr, config.Admin.User, config.Admin.Pass)
 
 	//go mdnsServer()
 
-	if videosDir = config.VideosDir; videosDir == "" {
-		logger.Println("no videos_dir defined, using default value")
-		videosDir = "./cameras"
-	}
-
-	if ffmpeg = config.FFMPEG; ffmpeg == "" {
-		logger.Println("ffmpeg path undifined, using default value")
-		ffmpeg = "/usr/local/bin/ffmpeg"
-	}
-
-	StartConverter()
-
-	ScanExistingFiles()
-
-
-	if duration = config.Duration; duration == 0 {
-		logger.Println("no duration defined, using default value")
-		duration = time.Hour * 1
-	}
+	loadDefaults()
 
 	logger.Printf("videos duration: %s", duration)
 
@@ -127,25 +157,15 @@ func main() {
 
 	led.BadHD()
 
-	mountedDir = safeShell(config.MountDir)
-	mountDev = safeShell(config.MountDev)
-	mountLabel = safeShell(config.MountLabel)
-
-	vigilantDB := os.Getenv("DB")
-	if vigilantDB == "" {
-		vigilantDB = "/home/pi/vigilantpi/db.json"
-		log.Printf("No DB env. Default DB to %s", vigilantDB)
-	}
-
-	if err := db.Init(vigilantDB); err != nil {
-		logger.Printf("error opening .json database: %s", err)
-	}
+	initDB()
 	defer db.Close()
 
 	logger.Println("started!")
+	initNotifiers()
 	go telegramBot()
+	go notificationDigest()
 
-	telegramNotifyf("VigilantPI started at %s", started.Format("15:04:05 - 02/01/2006"))
+	notifyf(eventGeneral, "", "VigilantPI started at %s", started.Format("15:04:05 - 02/01/2006"))
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -156,11 +176,11 @@ func main() {
 			pause, err := time.ParseDuration(p)
 			if err == nil && pause > 0 {
 				msg := fmt.Sprintf("System paused %s! Restart to resume.", pause)
-				logger.Printf(msg)
-				telegramNotifyf(msg)
+				logger.Print(msg)
+				notifyf(eventGeneral, "", "%s", msg)
 				time.Sleep(pause)
 				logger.Print("System resumed!")
-				telegramNotifyf("System resumed!")
+				notifyf(eventGeneral, "", "System resumed!")
 			}
 		}
 		run(ctx, config.Cameras)
@@ -169,12 +189,15 @@ func main() {
 
 	go crond(config.Cron)
 
-	if config.HealthCheckURL != "" {
-		go healthcheck()
+	go timelapsed()
+
+	if config.HealthCheckURL != "" || config.Heartbeat.URL != "" {
+		go heartbeat()
 	}
 
 	<-stop
 	cancel()
+	haStop()
 
 	logger.Println("waiting recordings to finish")
 	select {
@@ -198,54 +221,67 @@ func main() {
 	}
 }
 
-func healthcheck() {
-	log.Printf("health check enabled")
-	for range time.NewTicker(time.Minute * 5).C {
-		healthy := true
-		if !hddIsMounted() {
-			healthy = false
-		}
+func initDB() {
+	vigilantDB := os.Getenv("DB")
+	if vigilantDB == "" {
+		vigilantDB = "/home/pi/vigilantpi/db.json"
+		log.Printf("No DB env. Default DB to %s", vigilantDB)
+	}
 
-		for _, c := range cameraByName {
-			if !c.healthy {
-				healthy = false
-			}
-		}
+	if err := db.Init(vigilantDB); err != nil {
+		logger.Printf("error opening .json database: %s", err)
+	}
+}
 
-		if healthy {
-			req, err := http.NewRequest(http.MethodGet, config.HealthCheckURL, nil)
-			if err != nil {
-				log.Printf("error on health check url: %s: %s", config.HealthCheckURL, err)
-				return
-			}
-			res, err := tasksClient.Do(req)
-			if err != nil {
-				log.Printf("error on health check request: %s", err)
-				return
-			}
-			defer res.Body.Close()
-		}
+func loadDefaults() {
+	initStorages()
+
+	if ffmpeg = config.FFMPEG; ffmpeg == "" {
+		logger.Println("ffmpeg path undifined, using default value")
+		ffmpeg = "/usr/local/bin/ffmpeg"
+	}
+
+	if duration = config.Duration; duration == 0 {
+		logger.Println("no duration defined, using default value")
+		duration = time.Hour * 1
 	}
 }
 
 func run(ctx context.Context, cameras []Camera) {
-	if !hddIsMounted() {
+	go mountMonitor()
+
+	if checkStorages() == nil {
 		led.BadHD()
-		for !hddIsMounted() {
-			tryMount()
+		for checkStorages() == nil {
 			logger.Println("hdd is not mounted. waiting..")
 			time.Sleep(time.Second * 10)
 		}
 	}
-	logger.Println("hdd is mounted")
+	logger.Printf("hdd is mounted, recording to %s", currentStorage().Name)
 
 	updateConfig()
 
 	led.On()
 
-	go oldFilesWatcher(config.DeleteAfterDays)
+	startQueue()
+
+	atomic.StoreInt32(&ready, 1)
+
+	go downgraded()
+
+	go oldFilesWatcher()
+
+	go storageWatcher()
+
+	go systemMonitor()
+
+	if config.SMART.Enabled {
+		go smartMonitor()
+	}
 
 	done := make(chan struct{})
+	var doneOnce sync.Once
+	finish := func() { doneOnce.Do(func() { close(done) }) }
 	var running int32
 	var shouldExit bool
 
@@ -283,7 +319,7 @@ func run(ctx context.Context, cameras []Camera) {
 					go func() {
 						select {
 						case <-stillProcessing:
-							if c.healthy && !shouldExit {
+							if c.state().ok() && !shouldExit {
 								release()
 							}
 
@@ -296,32 +332,61 @@ func run(ctx context.Context, cameras []Camera) {
 					result := atomic.AddInt32(&running, -1)
 					if shouldExit {
 						if result == 0 {
-							done <- struct{}{}
+							finish()
 						}
 						return
 					}
-					if c.healthy {
+					if c.state().ok() {
 						release()
 						return
 					}
-					time.Sleep(time.Second * 10)
-					release()
+					select {
+					case <-time.After(time.Second * 10):
+						release()
+					case <-ctx.Done():
+						// stopped while waiting to retry
+						if atomic.LoadInt32(&running) == 0 {
+							finish()
+						}
+					}
 				}()
 			}
 		}
 	}()
 
+	if config.HomeAssistant.URL != "" {
+		startHomeAssistant()
+	}
+	recording := 0
 	for _, camera := range cameras {
-		camera := camera
-		camera.Healthy()
-		camera.SetupMotionDetection()
-		cameraByName[camera.Name] = &camera
-		rec <- &camera
+		c := cameraByName[camera.Name]
+		if c.Disabled {
+			c.state().transition(camDisabled)
+			continue
+		}
+		c.SetupMotionDetection()
+		rec <- c
+		recording++
 	}
 
+	if recording == 0 {
+		// every camera is disabled, nothing would signal done
+		logger.Println("no cameras to record")
+		<-ctx.Done()
+		return
+	}
 	<-done
 }
 
+// indexCameras fills cameraByName. It must run before anything reading the
+// map is started, the map isn't written after it.
+func indexCameras(cameras []Camera) {
+	for _, camera := range cameras {
+		camera := camera
+		cameraByName[camera.Name] = &camera
+	}
+}
+
 func clearLogs() {
 	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0755)
 	if err != nil {
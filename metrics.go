@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsWriter writes gauges on the prometheus text format, samples
+// are grouped by metric in the order they are first written.
+type metricsWriter struct {
+	names   []string
+	help    map[string]string
+	samples map[string][]string
+}
+
+// gauge adds a sample, labels are name and value pairs.
+func (m *metricsWriter) gauge(name, help string, v float64, labels ...string) {
+	name = "vigilantpi_" + name
+	if _, ok := m.help[name]; !ok {
+		m.names = append(m.names, name)
+		m.help[name] = help
+	}
+	sample := name
+	if len(labels) > 1 {
+		var pairs []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+		}
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	m.samples[name] = append(m.samples[name], sample+" "+strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+func (m *metricsWriter) String() string {
+	var b strings.Builder
+	for _, name := range m.names {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, m.help[name], name)
+		for _, s := range m.samples[name] {
+			b.WriteString(s + "\n")
+		}
+	}
+	return b.String()
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	m := &metricsWriter{help: make(map[string]string), samples: make(map[string][]string)}
+
+	m.gauge("uptime_seconds", "Seconds since vigilantpi started.", time.Since(started).Seconds())
+
+	sys := currentSystem()
+	m.gauge("cpu_temperature_celsius", "Highest thermal zone temperature.", sys.Temperature)
+	for _, z := range sys.Zones {
+		m.gauge("thermal_zone_celsius", "Thermal zone temperature.", z.Temperature, "zone", z.Type)
+	}
+	if sys.Throttled != nil {
+		m.gauge("throttled", "vcgencmd get_throttled flags.", float64(*sys.Throttled))
+		m.gauge("under_voltage", "Under-voltage now.", boolGauge(sys.UnderVoltage))
+		m.gauge("cpu_throttling", "CPU throttled now.", boolGauge(sys.Throttling))
+	}
+	m.gauge("memory_total_bytes", "Total memory.", float64(sys.MemTotal))
+	m.gauge("memory_available_bytes", "Available memory.", float64(sys.MemAvailable))
+	m.gauge("load1", "1 minute load average.", sys.Load1)
+	m.gauge("load5", "5 minutes load average.", sys.Load5)
+	m.gauge("load15", "15 minutes load average.", sys.Load15)
+
+	for _, st := range camerasStatus() {
+		m.gauge("camera_healthy", "Camera not reconnecting nor failing.", boolGauge(okState(st.State)), "camera", st.Name)
+		for _, state := range []string{camStarting, camRecording, camReconnecting, camFailing, camDisabled, camIdle} {
+			m.gauge("camera_state", "Current state of the camera.", boolGauge(st.State == state), "camera", st.Name, "state", state)
+		}
+		m.gauge("camera_consecutive_failures", "Failed recordings in a row.", float64(st.Failures), "camera", st.Name)
+		m.gauge("camera_uptime_percent", "Percent of the time recording.", st.Uptime, "camera", st.Name)
+		if st.LastSegment != nil {
+			m.gauge("camera_last_segment_timestamp_seconds", "When the last segment was finished.", float64(st.LastSegment.Unix()), "camera", st.Name)
+		}
+	}
+
+	for _, s := range storagesStatus() {
+		m.gauge("storage_active", "Storage receiving the recordings.", boolGauge(s.Active), "storage", s.Name)
+		m.gauge("storage_healthy", "Storage mounted, writable and above its floor.", boolGauge(s.Healthy), "storage", s.Name)
+		m.gauge("storage_free_bytes", "Free space of the storage.", float64(s.Free), "storage", s.Name)
+		m.gauge("storage_size_bytes", "Size of the storage.", float64(s.Total), "storage", s.Name)
+	}
+
+	q := queueStatus()
+	m.gauge("queue_pending_jobs", "Jobs waiting on the queue.", float64(q.Pending))
+	m.gauge("queue_running_jobs", "Jobs being processed.", float64(q.Running))
+	m.gauge("queue_retrying_jobs", "Jobs waiting for a retry.", float64(q.Retrying))
+	m.gauge("queue_quarantined_files", "Files moved to quarantine.", float64(len(q.Quarantined)))
+
+	for _, d := range disksHealth() {
+		l := []string{"storage", d.Storage, "device", d.Device}
+		m.gauge("disk_healthy", "Disk passes SMART and has no bad sectors.", boolGauge(d.healthy()), l...)
+		if !d.read {
+			continue
+		}
+		m.gauge("disk_smart_passed", "SMART overall self assessment.", boolGauge(d.Passed), l...)
+		m.gauge("disk_temperature_celsius", "Disk temperature.", float64(d.Temperature), l...)
+		m.gauge("disk_reallocated_sectors", "Reallocated sectors count (SMART 5).", float64(d.Reallocated), l...)
+		m.gauge("disk_pending_sectors", "Current pending sectors (SMART 197).", float64(d.Pending), l...)
+		m.gauge("disk_uncorrectable_sectors", "Offline uncorrectable sectors (SMART 198).", float64(d.Uncorrectable), l...)
+		m.gauge("disk_media_errors", "NVMe media errors.", float64(d.MediaErrors), l...)
+		m.gauge("disk_power_on_hours", "Disk power on hours.", float64(d.PowerOnHours), l...)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(m.String()))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mountinfoPath = "/proc/self/mountinfo"
+
+	mountCheckInterval = time.Second * 10
+	writeProbeInterval = time.Minute
+	writeProbeFile     = ".vigilantpi_probe"
+)
+
+// mountEntry is a line of /proc/self/mountinfo, see proc(5).
+type mountEntry struct {
+	ID           int
+	Parent       int
+	MountPoint   string
+	Options      string
+	FSType       string
+	Source       string
+	SuperOptions string
+}
+
+func (m mountEntry) readOnly() bool {
+	for _, opts := range []string{m.Options, m.SuperOptions} {
+		for _, o := range strings.Split(opts, ",") {
+			if o == "ro" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseMountinfo parses the mountinfo format:
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountinfo(r io.Reader) ([]mountEntry, error) {
+	var entries []mountEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 6 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("invalid mountinfo line %q", scanner.Text())
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount id %q", fields[0])
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid parent id %q", fields[1])
+		}
+
+		e := mountEntry{
+			ID:         id,
+			Parent:     parent,
+			MountPoint: unescapeMountinfo(fields[4]),
+			Options:    fields[5],
+			FSType:     fields[sep+1],
+			Source:     unescapeMountinfo(fields[sep+2]),
+		}
+		if len(fields) > sep+3 {
+			e.SuperOptions = fields[sep+3]
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// unescapeMountinfo decodes the octal escapes used for spaces, tabs,
+// new lines and backslashes.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func readMountinfo() ([]mountEntry, error) {
+	f, err := os.Open(mountinfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountinfo(f)
+}
+
+// findMount returns the last mount on dir, which is the visible one when
+// mounts are stacked.
+func findMount(entries []mountEntry, dir string) (mountEntry, bool) {
+	dir = filepath.Clean(dir)
+	var found mountEntry
+	var ok bool
+	for _, e := range entries {
+		if e.MountPoint == dir {
+			found, ok = e, true
+		}
+	}
+	return found, ok
+}
+
+type mountState struct {
+	mounted   bool
+	readOnly  bool
+	writeErr  string
+	source    string
+	fsType    string
+	lastProbe time.Time
+}
+
+var (
+	mountStatesMu sync.Mutex
+	mountStates   = make(map[*Storage]*mountState)
+)
+
+// writable is false when the storage was remounted read-only or the
+// last write probe failed.
+func (s *Storage) writable() (bool, string) {
+	mountStatesMu.Lock()
+	defer mountStatesMu.Unlock()
+	st, ok := mountStates[s]
+	switch {
+	case !ok:
+		return true, ""
+	case st.readOnly:
+		return false, "read-only"
+	case st.writeErr != "":
+		return false, st.writeErr
+	}
+	return true, ""
+}
+
+// mountMonitor follows the mounts of the storages, probing writes to
+// detect read-only remounts after i/o errors.
+func mountMonitor() {
+	for {
+		checkMounts()
+		time.Sleep(mountCheckInterval)
+	}
+}
+
+func checkMounts() {
+	entries, err := readMountinfo()
+	if err != nil {
+		logger.Printf("mount: error reading %s: %s", mountinfoPath, err)
+		return
+	}
+
+	for _, s := range storages {
+		// storages without mount_dir are only probed
+		e, mounted := mountEntry{}, true
+		if s.MountDir != "" {
+			e, mounted = findMount(entries, s.MountDir)
+		}
+
+		mountStatesMu.Lock()
+		st, ok := mountStates[s]
+		if !ok {
+			st = &mountState{}
+			mountStates[s] = st
+		}
+		prev := *st
+		st.mounted = mounted
+		st.readOnly = mounted && e.readOnly()
+		st.source, st.fsType = e.Source, e.FSType
+		if !mounted {
+			st.writeErr = ""
+		}
+		probe := mounted && !st.readOnly && time.Since(st.lastProbe) >= writeProbeInterval
+		mountStatesMu.Unlock()
+
+		if probe {
+			err := writeProbe(s.VideosDir)
+			mountStatesMu.Lock()
+			st.lastProbe = time.Now()
+			st.writeErr = ""
+			if err != nil {
+				st.writeErr = err.Error()
+			}
+			mountStatesMu.Unlock()
+		}
+
+		mountStatesMu.Lock()
+		cur := *st
+		mountStatesMu.Unlock()
+		if ok {
+			mountEvents(s, prev, cur)
+		}
+	}
+}
+
+// mountEvents reports mount changes and fails over right away when the
+// storage in use is gone.
+func mountEvents(s *Storage, prev, cur mountState) {
+	var event string
+	bad := false
+	switch {
+	case !prev.mounted && cur.mounted:
+		// mount reports its own results to telegram
+		logger.Printf("mount: %s mounted (%s %s)", s.Name, cur.source, cur.fsType)
+		return
+	case prev.mounted && !cur.mounted:
+		event, bad = fmt.Sprintf("%s was unmounted", s.Name), true
+	case !prev.readOnly && cur.readOnly:
+		event, bad = fmt.Sprintf("%s was remounted read-only", s.Name), true
+	case prev.readOnly && !cur.readOnly:
+		event = fmt.Sprintf("%s is writable again", s.Name)
+	case prev.writeErr == "" && cur.writeErr != "":
+		event, bad = fmt.Sprintf("%s is not writable: %s", s.Name, cur.writeErr), true
+	case prev.writeErr != "" && cur.writeErr == "" && cur.mounted:
+		event = fmt.Sprintf("%s is writable again", s.Name)
+	default:
+		return
+	}
+
+	logger.Printf("mount: %s", event)
+	if !bad || s != currentStorage() {
+		notifyf(eventStorage, s.Name, "%s", event)
+		return
+	}
+	notifyCriticalf(eventStorage, s.Name, "%s", event)
+	led.BadHD()
+	go checkStorages()
+}
+
+func writeProbe(dir string) error {
+	if err := os.MkdirAll(dir, 0774); err != nil {
+		return err
+	}
+	file := path.Join(dir, writeProbeFile)
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(time.Now().String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func readMountinfoFixture(t *testing.T) []mountEntry {
+	t.Helper()
+	f, err := os.Open("testdata/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := parseMountinfo(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestParseMountinfo(t *testing.T) {
+	entries := readMountinfoFixture(t)
+	if len(entries) != 12 {
+		t.Fatalf("got %d entries, want 12", len(entries))
+	}
+
+	// optional fields before the separator
+	want := mountEntry{
+		ID:           35,
+		Parent:       22,
+		MountPoint:   "/mnt/hdd",
+		Options:      "rw,noatime",
+		FSType:       "ext4",
+		Source:       "/dev/sda1",
+		SuperOptions: "rw",
+	}
+	if entries[5] != want {
+		t.Errorf("got %+v, want %+v", entries[5], want)
+	}
+
+	// no optional fields
+	if e := entries[7]; e.FSType != "exfat" || e.Source != "/dev/sdb1" || e.Options != "rw,relatime" {
+		t.Errorf("entry without optional fields: %+v", e)
+	}
+
+	// escaped space and backslash
+	if e := entries[7]; e.MountPoint != "/mnt/usb disk" {
+		t.Errorf("got mount point %q, want %q", e.MountPoint, "/mnt/usb disk")
+	}
+	if e := entries[9]; e.Source != `//nas/vigilant\pi` {
+		t.Errorf("got source %q, want %q", e.Source, `//nas/vigilant\pi`)
+	}
+}
+
+func TestParseMountinfoInvalid(t *testing.T) {
+	for _, line := range []string{
+		"35 22 8:1 / /mnt/hdd rw,noatime ext4 /dev/sda1 rw",
+		"35 22 8:1 / /mnt/hdd - ext4 /dev/sda1 rw",
+		"35 22 8:1 / /mnt/hdd rw,noatime - ext4",
+		"x 22 8:1 / /mnt/hdd rw,noatime - ext4 /dev/sda1 rw",
+		"35 x 8:1 / /mnt/hdd rw,noatime - ext4 /dev/sda1 rw",
+	} {
+		if _, err := parseMountinfo(strings.NewReader(line + "\n")); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestUnescapeMountinfo(t *testing.T) {
+	for in, want := range map[string]string{
+		"/mnt/hdd":            "/mnt/hdd",
+		`/mnt/usb\040disk`:    "/mnt/usb disk",
+		`/mnt/a\011b\012c`:    "/mnt/a\tb\nc",
+		`/mnt/back\134slash`:  `/mnt/back\slash`,
+		`/mnt/end\040`:        "/mnt/end ",
+		`/mnt/short\04`:       `/mnt/short\04`,
+		`/mnt/not\999octal`:   `/mnt/not\999octal`,
+		`/mnt/overflow\777x`:  `/mnt/overflow\777x`,
+		`\040leading`:         " leading",
+		`/mnt/two\040\040sp`:  "/mnt/two  sp",
+		`/mnt/trailing\`:      `/mnt/trailing\`,
+		`/mnt/mixed\040a\134`: `/mnt/mixed a\`,
+	} {
+		if got := unescapeMountinfo(in); got != want {
+			t.Errorf("unescapeMountinfo(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	entries := readMountinfoFixture(t)
+
+	for _, tt := range []struct {
+		dir      string
+		found    bool
+		id       int
+		readOnly bool
+	}{
+		{dir: "/", found: true, id: 22},
+		// stacked mounts, the last one is visible
+		{dir: "/mnt/hdd", found: true, id: 41},
+		{dir: "/mnt/hdd/", found: true, id: 41},
+		{dir: "/mnt/hdd/../hdd", found: true, id: 41},
+		// bind mount of a sub directory
+		{dir: "/srv/cameras", found: true, id: 36},
+		{dir: "/mnt/usb disk", found: true, id: 37},
+		// read-only remount
+		{dir: "/mnt/backup", found: true, id: 38, readOnly: true},
+		// read-only on the super block only
+		{dir: "/mnt/errors", found: true, id: 40, readOnly: true},
+		// errors=remount-ro isn't read-only
+		{dir: "/boot", found: true, id: 29},
+		// missing mounts and sub directories of mounts
+		{dir: "/mnt/usb", found: false},
+		{dir: "/mnt/hdd2", found: false},
+		{dir: "/mnt/hdd/cameras", found: false},
+		{dir: "/media/missing", found: false},
+	} {
+		e, ok := findMount(entries, tt.dir)
+		if ok != tt.found {
+			t.Errorf("%s: found %v, want %v", tt.dir, ok, tt.found)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if e.ID != tt.id {
+			t.Errorf("%s: got mount %d, want %d", tt.dir, e.ID, tt.id)
+		}
+		if e.readOnly() != tt.readOnly {
+			t.Errorf("%s: read-only %v, want %v", tt.dir, e.readOnly(), tt.readOnly)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+)
+
+const (
+	tsPacketSize = 188
+
+	tsPMTPID   = 0x1000
+	tsVideoPID = 0x100
+
+	// delay between pcr and pts/dts, gives players some room to buffer
+	tsPTSOffset = 63000
+)
+
+var (
+	tsCRCTable = func() (t [256]uint32) {
+		for i := range t {
+			crc := uint32(i) << 24
+			for j := 0; j < 8; j++ {
+				if crc&0x80000000 != 0 {
+					crc = crc<<1 ^ 0x04c11db7
+				} else {
+					crc <<= 1
+				}
+			}
+			t[i] = crc
+		}
+		return
+	}()
+
+	h264AUD = []byte{0, 0, 0, 1, 0x09, 0xf0}
+	h265AUD = []byte{0, 0, 0, 1, 0x46, 0x01, 0x50}
+)
+
+func tsCRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ tsCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// tsMuxer writes a single video stream as MPEG-TS.
+type tsMuxer struct {
+	w     io.Writer
+	codec string
+
+	patCC, pmtCC, videoCC uint8
+
+	pkt [tsPacketSize]byte
+}
+
+func newTSMuxer(w io.Writer, codec string) *tsMuxer {
+	return &tsMuxer{w: w, codec: codec}
+}
+
+// WriteAccessUnit writes au with pts in 90kHz units. Tables are repeated
+// before every keyframe so the stream can be cut or joined on them.
+func (m *tsMuxer) WriteAccessUnit(au *accessUnit, pts int64) error {
+	if au.key {
+		if err := m.writeTables(); err != nil {
+			return err
+		}
+	}
+
+	aud := h264AUD
+	if m.codec == codecH265 {
+		aud = h265AUD
+	}
+
+	size := len(aud)
+	for _, nalu := range au.nalus {
+		size += 4 + len(nalu)
+	}
+
+	pes := make([]byte, 0, 19+size)
+	pes = append(pes,
+		0x00, 0x00, 0x01, 0xe0, // start code, video stream
+		0x00, 0x00, // unbounded length
+		0x80, 0xc0, 10, // pts and dts
+	)
+	pes = appendTimestamp(pes, 0x3, pts+tsPTSOffset)
+	pes = appendTimestamp(pes, 0x1, pts+tsPTSOffset)
+	pes = append(pes, aud...)
+	for _, nalu := range au.nalus {
+		pes = append(pes, 0, 0, 0, 1)
+		pes = append(pes, nalu...)
+	}
+
+	var af []byte
+	if au.key {
+		af = []byte{0x50} // random access, pcr
+	} else {
+		af = []byte{0x10} // pcr
+	}
+	// pcr base only, extension is always zero
+	base := pts & 0x1ffffffff
+	af = append(af,
+		byte(base>>25),
+		byte(base>>17),
+		byte(base>>9),
+		byte(base>>1),
+		byte(base<<7)|0x7e,
+		0,
+	)
+
+	for pusi := true; len(pes) > 0; pusi = false {
+		n, err := m.writePacket(tsVideoPID, &m.videoCC, pusi, af, pes)
+		if err != nil {
+			return err
+		}
+		pes = pes[n:]
+		af = nil
+	}
+	return nil
+}
+
+func appendTimestamp(b []byte, prefix byte, ts int64) []byte {
+	ts &= 0x1ffffffff
+	return append(b,
+		prefix<<4|byte(ts>>29)&0x0e|1,
+		byte(ts>>22),
+		byte(ts>>14)|1,
+		byte(ts>>7),
+		byte(ts<<1)|1,
+	)
+}
+
+func (m *tsMuxer) writeTables() error {
+	pat := []byte{
+		0x00,       // table id
+		0xb0, 0x0d, // section length
+		0x00, 0x01, // transport stream id
+		0xc1, 0x00, 0x00, // version, section numbers
+		0x00, 0x01, // program number
+		0xe0 | tsPMTPID>>8, tsPMTPID & 0xff,
+	}
+	if err := m.writeSection(0, &m.patCC, pat); err != nil {
+		return err
+	}
+
+	streamType := byte(0x1b)
+	if m.codec == codecH265 {
+		streamType = 0x24
+	}
+	pmt := []byte{
+		0x02,       // table id
+		0xb0, 0x12, // section length
+		0x00, 0x01, // program number
+		0xc1, 0x00, 0x00, // version, section numbers
+		0xe0 | tsVideoPID>>8, tsVideoPID & 0xff, // pcr pid
+		0xf0, 0x00, // program info length
+		streamType,
+		0xe0 | tsVideoPID>>8, tsVideoPID & 0xff,
+		0xf0, 0x00, // es info length
+	}
+	return m.writeSection(tsPMTPID, &m.pmtCC, pmt)
+}
+
+func (m *tsMuxer) writeSection(pid uint16, cc *uint8, section []byte) error {
+	crc := tsCRC32(section)
+	payload := make([]byte, 0, tsPacketSize-4)
+	payload = append(payload, 0) // pointer field
+	payload = append(payload, section...)
+	payload = append(payload, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	for len(payload) < tsPacketSize-4 {
+		payload = append(payload, 0xff)
+	}
+	_, err := m.writePacket(pid, cc, true, nil, payload)
+	return err
+}
+
+// writePacket writes a single ts packet and returns how many bytes of
+// payload it carried. af is the adaptation field without its length byte.
+func (m *tsMuxer) writePacket(pid uint16, cc *uint8, pusi bool, af []byte, payload []byte) (int, error) {
+	p := m.pkt[:]
+	p[0] = 0x47
+	p[1] = byte(pid>>8) & 0x1f
+	if pusi {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+
+	afLen := 0
+	if af != nil {
+		afLen = 1 + len(af)
+	}
+
+	n := len(payload)
+	if max := tsPacketSize - 4 - afLen; n > max {
+		n = max
+	}
+
+	if stuff := tsPacketSize - 4 - afLen - n; stuff > 0 {
+		if af == nil {
+			af = []byte{}
+			afLen = 1
+			stuff--
+			if stuff > 0 {
+				af = append(af, 0x00)
+				afLen++
+				stuff--
+			}
+		}
+		for ; stuff > 0; stuff-- {
+			af = append(af, 0xff)
+			afLen++
+		}
+	}
+
+	p[3] = 0x10 | *cc&0x0f
+	*cc++
+
+	i := 4
+	if af != nil {
+		p[3] |= 0x20
+		p[4] = byte(len(af))
+		copy(p[5:], af)
+		i += afLen
+	}
+	copy(p[i:], payload[:n])
+
+	_, err := m.w.Write(p)
+	return n, err
+}
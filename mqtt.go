@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultMQTTTopic    = "vigilantpi"
+	mqttReconnectPeriod = time.Second * 10
+)
+
+// mqttClientID is the configured id, or one unique to the host, process
+// and client. Brokers drop the previous connection of a reused id.
+func mqttClientID(id, client string) string {
+	if id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("vigilantpi-%s-%d-%s", host, os.Getpid(), client)
+}
+
+// mqttConnect starts connecting in background, reconnecting whenever
+// the connection is lost. onConnect runs on every connection. The broker
+// publishes "offline" to willTopic when the connection is lost.
+func mqttConnect(broker, clientID, user, pass string, timeout time.Duration, willTopic string, onConnect func(mqtt.Client)) mqtt.Client {
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(user).
+		SetPassword(pass).
+		SetConnectTimeout(timeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttReconnectPeriod).
+		SetMaxReconnectInterval(mqttReconnectPeriod * 6).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Printf("mqtt: connection to %s lost: %s", broker, err)
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			logger.Printf("mqtt: connected to %s", broker)
+			if onConnect != nil {
+				onConnect(c)
+			}
+		})
+	if willTopic != "" {
+		opts.SetWill(willTopic, "offline", 1, true)
+	}
+	client := mqtt.NewClient(opts)
+	client.Connect()
+	return client
+}
+
+// mqttPublish waits the broker to acknowledge the message, or the
+// timeout. Messages published while connecting would be lost.
+func mqttPublish(client mqtt.Client, topic string, retained bool, payload interface{}, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !client.IsConnectionOpen() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not connected, can't publish to %s", topic)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	default:
+		var err error
+		if data, err = json.Marshal(p); err != nil {
+			return err
+		}
+	}
+	t := client.Publish(topic, 1, retained, data)
+	if !t.WaitTimeout(time.Until(deadline)) {
+		return fmt.Errorf("timeout publishing to %s", topic)
+	}
+	return t.Error()
+}
+
+// mqttNotifier publishes notifications as json.
+type mqttNotifier struct {
+	NotifierConfig
+	client mqtt.Client
+}
+
+func newMQTTNotifier(nc NotifierConfig) (Notifier, error) {
+	if nc.URL == "" {
+		return nil, fmt.Errorf("mqtt requires the broker url")
+	}
+	if nc.Topic == "" {
+		nc.Topic = defaultMQTTTopic
+	}
+	nc.Topic = strings.TrimSuffix(nc.Topic, "/")
+	clientID := mqttClientID(nc.ClientID, "notify-"+slug(nc.Name))
+	client := mqttConnect(nc.URL, clientID, nc.User, nc.Pass, nc.Timeout, "", nil)
+	return &mqttNotifier{NotifierConfig: nc, client: client}, nil
+}
+
+func (n *mqttNotifier) Name() string {
+	return n.NotifierConfig.Name
+}
+
+func (n *mqttNotifier) Notify(msg Notification) error {
+	return mqttPublish(n.client, n.Topic+"/events/"+msg.Event, false, newNotificationPayload(msg), n.Timeout)
+}
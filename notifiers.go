@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultNotifierTimeout = time.Second * 10
+
+// NotifierConfig is a channel notifications are sent to, besides the
+// telegram bot.
+type NotifierConfig struct {
+	// used on routes, the type when empty
+	Name string `yaml:"name"`
+	// webhook, smtp, ntfy, gotify or mqtt
+	Type string `yaml:"type"`
+
+	// webhook url, ntfy topic url (https://ntfy.sh/mytopic), gotify
+	// server or mqtt broker (tcp://host:1883, ssl://host:8883)
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// ntfy access token or gotify application token
+	Token string `yaml:"token"`
+
+	// smtp server, implicit tls on port 465 and starttls when offered
+	Host string   `yaml:"host"`
+	Port int      `yaml:"port"`
+	TLS  bool     `yaml:"tls"`
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+
+	// smtp and mqtt
+	User string `yaml:"user"`
+	Pass string `yaml:"pass"`
+
+	// mqtt, events are published to <topic>/events/<event>
+	Topic    string `yaml:"topic"`
+	ClientID string `yaml:"client_id"`
+
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (nc NotifierConfig) name() string {
+	if nc.Name == "" {
+		return nc.Type
+	}
+	return nc.Name
+}
+
+func newNotifier(nc NotifierConfig) (Notifier, error) {
+	nc.Name = nc.name()
+	if nc.Timeout <= 0 {
+		nc.Timeout = defaultNotifierTimeout
+	}
+	switch nc.Type {
+	case "webhook", "ntfy", "gotify":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("%s requires an url", nc.Type)
+		}
+		return &httpNotifier{NotifierConfig: nc, client: &http.Client{Timeout: nc.Timeout}}, nil
+	case "smtp":
+		if nc.Host == "" || len(nc.To) == 0 {
+			return nil, errors.New("smtp requires host and to")
+		}
+		if nc.Port == 0 {
+			nc.Port = 587
+			if nc.TLS {
+				nc.Port = 465
+			}
+		}
+		if nc.From == "" {
+			nc.From = nc.User
+		}
+		return &smtpNotifier{nc}, nil
+	case "mqtt":
+		return newMQTTNotifier(nc)
+	}
+	return nil, fmt.Errorf("unknown type %q", nc.Type)
+}
+
+// notificationPayload is sent as json by webhooks and mqtt.
+type notificationPayload struct {
+	Event    string    `json:"event"`
+	Source   string    `json:"source,omitempty"`
+	Critical bool      `json:"critical"`
+	Text     string    `json:"text"`
+	Time     time.Time `json:"time"`
+	Version  string    `json:"version"`
+}
+
+func newNotificationPayload(msg Notification) notificationPayload {
+	return notificationPayload{
+		Event:    msg.Event,
+		Source:   msg.Source,
+		Critical: msg.Critical,
+		Text:     msg.Text,
+		Time:     time.Now(),
+		Version:  version,
+	}
+}
+
+func notificationTitle(msg Notification) string {
+	title := "VigilantPI " + msg.Event
+	if msg.Source != "" {
+		title += ": " + msg.Source
+	}
+	return title
+}
+
+// httpNotifier posts to webhooks, ntfy and gotify.
+type httpNotifier struct {
+	NotifierConfig
+	client *http.Client
+}
+
+func (n *httpNotifier) Name() string {
+	return n.NotifierConfig.Name
+}
+
+func (n *httpNotifier) Notify(msg Notification) error {
+	var (
+		url  = n.URL
+		body []byte
+		err  error
+	)
+	header := make(http.Header)
+
+	switch n.Type {
+	case "webhook":
+		header.Set("Content-Type", "application/json")
+		body, err = json.Marshal(newNotificationPayload(msg))
+	case "ntfy":
+		header.Set("Title", notificationTitle(msg))
+		header.Set("Tags", msg.Event)
+		if msg.Critical {
+			header.Set("Priority", "urgent")
+		}
+		if n.Token != "" {
+			header.Set("Authorization", "Bearer "+n.Token)
+		}
+		body = []byte(msg.Text)
+	case "gotify":
+		url = strings.TrimSuffix(url, "/") + "/message"
+		header.Set("Content-Type", "application/json")
+		header.Set("X-Gotify-Key", n.Token)
+		priority := 5
+		if msg.Critical {
+			priority = 8
+		}
+		body, err = json.Marshal(map[string]interface{}{
+			"title":    notificationTitle(msg),
+			"message":  msg.Text,
+			"priority": priority,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	for k, v := range n.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", "vigilantpi/"+version)
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", url, res.Status)
+	}
+	return nil
+}
+
+// smtpNotifier emails the notifications, images attached.
+type smtpNotifier struct {
+	NotifierConfig
+}
+
+func (n *smtpNotifier) Name() string {
+	return n.NotifierConfig.Name
+}
+
+func (n *smtpNotifier) Notify(msg Notification) error {
+	data, err := n.message(msg)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+	dialer := &net.Dialer{Timeout: n.Timeout}
+	var conn net.Conn
+	implicitTLS := n.TLS || n.Port == 465
+	if implicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: n.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the whole conversation, attachments included
+	conn.SetDeadline(time.Now().Add(n.Timeout * 6))
+
+	c, err := smtp.NewClient(conn, n.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if !implicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: n.Host}); err != nil {
+				return err
+			}
+		}
+	}
+	if n.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.User, n.Pass, n.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.From); err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (n *smtpNotifier) message(msg Notification) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	subject := notificationTitle(msg)
+	if msg.Critical {
+		subject = "[critical] " + subject
+	}
+	fmt.Fprintf(&buf, "From: %s\r\n", n.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	text := msg.Text
+	for _, v := range msg.Videos {
+		// too big to be attached
+		text += "\n\nvideo: " + v
+	}
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64(part, []byte(text))
+
+	for _, file := range msg.Images {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			logger.Printf("notifications: %s: can't attach %s: %s", n.Name(), file, err)
+			continue
+		}
+		ctype := mime.TypeByExtension(path.Ext(file))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {ctype},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", path.Base(file))},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writeBase64(part, data)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBase64 writes lines of 76 characters, as required by mime.
+func writeBase64(w io.Writer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		io.WriteString(w, enc[:76]+"\r\n")
+		enc = enc[76:]
+	}
+	io.WriteString(w, enc+"\r\n")
+}
+
+// notifyCmd sends a test notification to the configured notifiers, or
+// only to the named one.
+func notifyCmd(args []string) error {
+	var name string
+	if len(args) > 0 {
+		name = args[0]
+	}
+	text := "VigilantPI test notification"
+	if len(args) > 1 {
+		text = strings.Join(args[1:], " ")
+	}
+
+	var failed, sent int
+	for _, nc := range config.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return fmt.Errorf("invalid notifier %s: %s", nc.name(), err)
+		}
+		if name != "" && n.Name() != name {
+			continue
+		}
+		sent++
+		err = n.Notify(Notification{Text: text, Event: eventGeneral, Source: "test"})
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %s\n", n.Name(), err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: sent\n", n.Name())
+	}
+	switch {
+	case sent == 0 && name != "":
+		return fmt.Errorf("notifier %s not found", name)
+	case sent == 0:
+		return errors.New("no notifiers configured")
+	case failed > 0:
+		return fmt.Errorf("%d of %d notifiers failed", failed, sent)
+	}
+	return nil
+}
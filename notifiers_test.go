@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type capturedRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+func captureServer(t *testing.T, status int) (*httptest.Server, func() capturedRequest) {
+	var (
+		mu  sync.Mutex
+		req capturedRequest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		req = capturedRequest{method: r.Method, path: r.URL.Path, header: r.Header, body: body}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() capturedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return req
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	srv, last := captureServer(t, http.StatusNoContent)
+	n, err := newNotifier(NotifierConfig{
+		Type:    "webhook",
+		URL:     srv.URL + "/hook",
+		Headers: map[string]string{"X-Api-Key": "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Name() != "webhook" {
+		t.Errorf("got name %q, want the type", n.Name())
+	}
+
+	err = n.Notify(Notification{Text: "hdd is gone", Event: eventStorage, Source: "hdd", Critical: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := last()
+	if req.method != http.MethodPost || req.path != "/hook" {
+		t.Errorf("got %s %s, want POST /hook", req.method, req.path)
+	}
+	for k, v := range map[string]string{
+		"Content-Type": "application/json",
+		"X-Api-Key":    "secret",
+		"User-Agent":   "vigilantpi/" + version,
+	} {
+		if got := req.header.Get(k); got != v {
+			t.Errorf("header %s: got %q, want %q", k, got, v)
+		}
+	}
+
+	var payload notificationPayload
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("invalid body %s: %s", req.body, err)
+	}
+	if payload.Event != eventStorage || payload.Source != "hdd" || !payload.Critical || payload.Text != "hdd is gone" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+	if payload.Time.IsZero() {
+		t.Error("payload without time")
+	}
+}
+
+func TestNtfyNotifier(t *testing.T) {
+	srv, last := captureServer(t, http.StatusOK)
+	n, err := newNotifier(NotifierConfig{Name: "phone", Type: "ntfy", URL: srv.URL + "/cameras", Token: "tk_123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, critical := range []bool{false, true} {
+		err = n.Notify(Notification{Text: "motion on yard", Event: eventMotion, Source: "yard", Critical: critical})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := last()
+		if req.path != "/cameras" {
+			t.Errorf("got path %s, want /cameras", req.path)
+		}
+		priority := ""
+		if critical {
+			priority = "urgent"
+		}
+		for k, v := range map[string]string{
+			"Title":         "VigilantPI motion: yard",
+			"Tags":          eventMotion,
+			"Priority":      priority,
+			"Authorization": "Bearer tk_123",
+		} {
+			if got := req.header.Get(k); got != v {
+				t.Errorf("critical %v: header %s: got %q, want %q", critical, k, got, v)
+			}
+		}
+		if string(req.body) != "motion on yard" {
+			t.Errorf("got body %q", req.body)
+		}
+	}
+}
+
+func TestGotifyNotifier(t *testing.T) {
+	srv, last := captureServer(t, http.StatusOK)
+	n, err := newNotifier(NotifierConfig{Type: "gotify", URL: srv.URL + "/", Token: "app-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.Notify(Notification{Text: "disk failing", Event: eventDisk, Critical: true}); err != nil {
+		t.Fatal(err)
+	}
+	req := last()
+	if req.path != "/message" {
+		t.Errorf("got path %s, want /message", req.path)
+	}
+	if got := req.header.Get("X-Gotify-Key"); got != "app-token" {
+		t.Errorf("got key %q", got)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("got content type %q", got)
+	}
+	var body struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}
+	if err := json.Unmarshal(req.body, &body); err != nil {
+		t.Fatalf("invalid body %s: %s", req.body, err)
+	}
+	if body.Title != "VigilantPI disk" || body.Message != "disk failing" || body.Priority != 8 {
+		t.Errorf("unexpected body %+v", body)
+	}
+}
+
+func TestHTTPNotifierStatus(t *testing.T) {
+	srv, _ := captureServer(t, http.StatusUnauthorized)
+	n, err := newNotifier(NotifierConfig{Type: "ntfy", URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Notify(Notification{Text: "test", Event: eventGeneral})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("got %v, want the status", err)
+	}
+}
+
+// smtpTestServer accepts a single session without tls, answering every
+// command, and returns the commands and the message.
+func smtpTestServer(t *testing.T) (port int, result chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	result = make(chan []string, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := textproto.NewConn(conn)
+		var cmds []string
+		defer func() { result <- cmds }()
+
+		tc.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			cmds = append(cmds, line)
+			switch verb := strings.ToUpper(strings.Fields(line)[0]); verb {
+			case "EHLO":
+				tc.PrintfLine("250-localhost")
+				tc.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				tc.PrintfLine("235 ok")
+			case "DATA":
+				tc.PrintfLine("354 go ahead")
+				data, err := tc.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				cmds = append(cmds, string(data))
+				tc.PrintfLine("250 queued")
+			case "QUIT":
+				tc.PrintfLine("221 bye")
+				return
+			default:
+				tc.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, result
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	port, result := smtpTestServer(t)
+
+	image := path.Join(t.TempDir(), "yard.jpg")
+	imageData := bytes.Repeat([]byte{0xff, 0xd8, 0x00, 0x42}, 100)
+	if err := ioutil.WriteFile(image, imageData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := newNotifier(NotifierConfig{
+		Type: "smtp",
+		Host: "127.0.0.1",
+		Port: port,
+		User: "pi@example.com",
+		Pass: "secret",
+		To:   []string{"me@example.com", "you@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Notify(Notification{
+		Text:     "motion on yard",
+		Images:   []string{image, path.Join(t.TempDir(), "missing.jpg")},
+		Videos:   []string{"rec_2026_10_18/10_00_00_yard.mp4"},
+		Event:    eventMotion,
+		Source:   "yard",
+		Critical: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmds := <-result
+	if len(cmds) != 8 {
+		t.Fatalf("unexpected session %q", cmds)
+	}
+	wantAuth := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00pi@example.com\x00secret"))
+	for i, want := range []string{
+		"EHLO localhost",
+		wantAuth,
+		"MAIL FROM:<pi@example.com>",
+		"RCPT TO:<me@example.com>",
+		"RCPT TO:<you@example.com>",
+		"DATA",
+	} {
+		if !strings.HasPrefix(cmds[i], want) {
+			t.Errorf("command %d: got %q, want %q", i, cmds[i], want)
+		}
+	}
+	if cmds[7] != "QUIT" {
+		t.Errorf("got %q, want QUIT", cmds[7])
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(cmds[6]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("To"); got != "me@example.com, you@example.com" {
+		t.Errorf("got To %q", got)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "[critical] VigilantPI motion: yard" {
+		t.Errorf("got subject %q (%v)", subject, err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("got content type %q (%v)", msg.Header.Get("Content-Type"), err)
+	}
+
+	type part struct {
+		header textproto.MIMEHeader
+		data   []byte
+	}
+	var parts []part
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err != nil {
+			break
+		}
+		// the dot reader already turned crlf into lf
+		raw, _ := ioutil.ReadAll(p)
+		lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+		for _, line := range lines {
+			if len(line) > 76 {
+				t.Errorf("base64 line of %d characters", len(line))
+			}
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+		if err != nil {
+			t.Fatalf("invalid base64 part: %s", err)
+		}
+		parts = append(parts, part{p.Header, data})
+	}
+	// the missing image is skipped
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+
+	if ct := parts[0].header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("text part content type %q", ct)
+	}
+	wantText := "motion on yard\n\nvideo: rec_2026_10_18/10_00_00_yard.mp4"
+	if string(parts[0].data) != wantText {
+		t.Errorf("got text %q, want %q", parts[0].data, wantText)
+	}
+
+	if ct := parts[1].header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("attachment content type %q", ct)
+	}
+	if cd := parts[1].header.Get("Content-Disposition"); cd != `attachment; filename="yard.jpg"` {
+		t.Errorf("attachment disposition %q", cd)
+	}
+	if !bytes.Equal(parts[1].data, imageData) {
+		t.Error("attachment doesn't match the image")
+	}
+}
+
+// fakeNotifier only has a name, dispatch doesn't call Notify.
+type fakeNotifier struct {
+	name string
+}
+
+func (n fakeNotifier) Name() string                  { return n.name }
+func (n fakeNotifier) Notify(msg Notification) error { return nil }
+
+func TestNotifyRouteMatch(t *testing.T) {
+	msg := Notification{Event: eventStorage, Source: "hdd", Critical: true}
+	for i, tt := range []struct {
+		route NotifyRoute
+		msg   Notification
+		match bool
+	}{
+		{NotifyRoute{}, msg, true},
+		{NotifyRoute{Events: []string{eventStorage, eventDisk}}, msg, true},
+		{NotifyRoute{Events: []string{eventMotion}}, msg, false},
+		{NotifyRoute{Sources: []string{"hdd"}}, msg, true},
+		{NotifyRoute{Sources: []string{"sd card"}}, msg, false},
+		{NotifyRoute{Events: []string{eventStorage}, Sources: []string{"sd card"}}, msg, false},
+		{NotifyRoute{Critical: true}, msg, true},
+		{NotifyRoute{Critical: true}, Notification{Event: eventStorage}, false},
+		{NotifyRoute{Events: []string{eventStorage}, Sources: []string{"hdd"}, Critical: true}, msg, true},
+	} {
+		if got := tt.route.match(tt.msg); got != tt.match {
+			t.Errorf("route %d: got %v, want %v", i, got, tt.match)
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	prevConfig, prevNotifiers := config, notifiers
+	defer func() { config, notifiers = prevConfig, prevNotifiers }()
+
+	config = &Config{}
+	notifiers = nil
+	for _, name := range []string{"telegram", "email", "ntfy"} {
+		notifiers = append(notifiers, &notifierQueue{
+			Notifier: fakeNotifier{name},
+			ch:       make(chan Notification, notifierQueueSize),
+		})
+	}
+	received := func() []string {
+		var names []string
+		for _, q := range notifiers {
+			for len(q.ch) > 0 {
+				<-q.ch
+				names = append(names, q.Name())
+			}
+		}
+		return names
+	}
+
+	motion := Notification{Text: "motion", Event: eventMotion, Source: "yard"}
+	storage := Notification{Text: "hdd", Event: eventStorage, Source: "hdd", Critical: true}
+
+	// everything goes everywhere without routes
+	dispatch(motion)
+	if got, want := received(), []string{"telegram", "email", "ntfy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without routes got %v, want %v", got, want)
+	}
+
+	config.Notifications.Routes = []NotifyRoute{
+		{Events: []string{eventMotion}, To: []string{"telegram"}},
+		{Critical: true, To: []string{"email", "ntfy"}},
+		{Sources: []string{"hdd"}, To: []string{"telegram"}},
+	}
+	for _, tt := range []struct {
+		msg  Notification
+		want []string
+	}{
+		{motion, []string{"telegram"}},
+		{storage, []string{"telegram", "email", "ntfy"}},
+		{Notification{Text: "cpu", Event: eventSystem}, nil},
+	} {
+		dispatch(tt.msg)
+		if got := received(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.msg.Text, got, tt.want)
+		}
+	}
+
+	// a full queue doesn't block the others
+	for i := 0; i < notifierQueueSize; i++ {
+		notifiers[0].ch <- motion
+	}
+	dispatch(storage)
+	if n := len(notifiers[1].ch) + len(notifiers[2].ch); n != 2 {
+		t.Errorf("got %d notifications on the other queues, want 2", n)
+	}
+}
+
+func TestNotifyAllowCritical(t *testing.T) {
+	prevConfig := config
+	defer func() { config = prevConfig }()
+	config = &Config{Notifications: Notifications{
+		Limits: map[string]NotifyLimit{eventStorage: {Max: 1, Per: time.Hour}},
+	}}
+	m := &notifyManager{
+		sent: make(map[string][]time.Time),
+		seen: make(map[string]time.Time),
+		held: make(map[string]*heldNotifications),
+	}
+
+	// over the limit, but a different text
+	for _, text := range []string{"hdd is gone", "hdd is read-only"} {
+		if !m.allow(Notification{Text: text, Event: eventStorage, Critical: true}) {
+			t.Errorf("%q: critical notification over the limit was held", text)
+		}
+	}
+	// the same text again
+	if m.allow(Notification{Text: "hdd is gone", Event: eventStorage, Critical: true}) {
+		t.Error("repeated critical notification was sent")
+	}
+	if h := m.held[eventStorage]; h == nil || h.count != 1 {
+		t.Errorf("got held %+v, want 1", h)
+	}
+}
+
+type fakeMQTTToken struct {
+	mqtt.Token
+	acked bool
+}
+
+func (t fakeMQTTToken) WaitTimeout(time.Duration) bool { return t.acked }
+func (t fakeMQTTToken) Error() error                   { return nil }
+
+// fakeMQTTClient records what is published, acknowledging it when acked.
+type fakeMQTTClient struct {
+	mqtt.Client
+	connected, acked bool
+
+	published int
+	topic     string
+	retained  bool
+	payload   []byte
+}
+
+func (c *fakeMQTTClient) IsConnectionOpen() bool { return c.connected }
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published++
+	c.topic, c.retained = topic, retained
+	c.payload, _ = payload.([]byte)
+	return fakeMQTTToken{acked: c.acked}
+}
+
+func TestMQTTNotifier(t *testing.T) {
+	nc := NotifierConfig{Type: "mqtt", URL: "tcp://127.0.0.1:1", Topic: "home/cameras/", Timeout: time.Millisecond * 300}
+	notifier, err := newNotifier(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := notifier.(*mqttNotifier)
+	n.client.Disconnect(0)
+
+	client := &fakeMQTTClient{connected: true, acked: true}
+	n.client = client
+	if err := n.Notify(Notification{Text: "hdd is gone", Event: eventStorage, Source: "hdd", Critical: true}); err != nil {
+		t.Fatal(err)
+	}
+	if client.topic != "home/cameras/events/storage" || client.retained {
+		t.Errorf("got topic %q retained %v, want home/cameras/events/storage not retained", client.topic, client.retained)
+	}
+	var payload notificationPayload
+	if err := json.Unmarshal(client.payload, &payload); err != nil {
+		t.Fatalf("invalid payload %q: %s", client.payload, err)
+	}
+	if payload.Event != eventStorage || payload.Source != "hdd" || !payload.Critical || payload.Text != "hdd is gone" || payload.Time.IsZero() {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+	// nothing is published before connecting
+	client = &fakeMQTTClient{acked: true}
+	n.client = client
+	start := time.Now()
+	err = n.Notify(Notification{Text: "motion", Event: eventMotion})
+	if err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Errorf("got %v, want a not connected error", err)
+	}
+	if took := time.Since(start); took < nc.Timeout {
+		t.Errorf("gave up after %s, before the timeout", took)
+	}
+	if client.published != 0 {
+		t.Errorf("published %d messages while not connected", client.published)
+	}
+
+	// the broker never acknowledges
+	n.client = &fakeMQTTClient{connected: true}
+	err = n.Notify(Notification{Text: "motion", Event: eventMotion})
+	if err == nil || !strings.Contains(err.Error(), "timeout publishing to home/cameras/events/motion") {
+		t.Errorf("got %v, want a publish timeout", err)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notification event types, each one with its own rate limit
+const (
+	eventGeneral   = "general"
+	eventCamera    = "camera"
+	eventMotion    = "motion"
+	eventStorage   = "storage"
+	eventDisk      = "disk"
+	eventSystem    = "system"
+	eventRecording = "recording"
+	eventTimelapse = "timelapse"
+	eventTask      = "task"
+)
+
+const (
+	defaultNotifyDedup  = time.Minute * 10
+	defaultNotifyDigest = time.Hour
+	notifyDigestCheck   = time.Minute
+)
+
+// default limits, per event type and source
+var defaultNotifyLimits = map[string]NotifyLimit{
+	eventGeneral: {Max: 10, Per: time.Hour},
+	eventCamera:  {Max: 4, Per: time.Hour},
+	eventMotion:  {Max: 6, Per: time.Hour},
+}
+
+// Notifications throttles and routes what is sent to the notifiers. Held
+// notifications are summarized on a digest.
+type Notifications struct {
+	// same text from the same source is sent once in the window
+	Dedup time.Duration `yaml:"dedup"`
+	// how often held notifications are summarized
+	Digest time.Duration `yaml:"digest"`
+	// only critical events are sent in the window, durations since
+	// midnight. end may be before start
+	QuietHours *struct {
+		Start time.Duration `yaml:"start"`
+		End   time.Duration `yaml:"end"`
+	} `yaml:"quiet_hours"`
+	// per event type, "general" is used by the types not listed
+	Limits map[string]NotifyLimit `yaml:"limits"`
+	// event types never rate limited nor held in the quiet hours
+	Critical []string `yaml:"critical"`
+	// which notifiers receive each event, all of them when empty
+	Routes []NotifyRoute `yaml:"routes"`
+}
+
+// NotifyRoute sends the matching notifications to the To notifiers.
+type NotifyRoute struct {
+	// all when empty
+	Events  []string `yaml:"events"`
+	Sources []string `yaml:"sources"`
+	// only critical notifications
+	Critical bool `yaml:"critical"`
+	// notifier names, the telegram bot is "telegram"
+	To []string `yaml:"to"`
+}
+
+func (r NotifyRoute) match(msg Notification) bool {
+	return (len(r.Events) == 0 || contains(r.Events, msg.Event)) &&
+		(len(r.Sources) == 0 || contains(r.Sources, msg.Source)) &&
+		(!r.Critical || msg.Critical)
+}
+
+// Notification is sent to every notifier routed to its event.
+type Notification struct {
+	Text   string
+	Images []string
+	Videos []string
+
+	Event    string
+	Source   string
+	Critical bool
+}
+
+// Notifier is an outbound channel, like telegram or email.
+type Notifier interface {
+	Name() string
+	Notify(msg Notification) error
+}
+
+const notifierQueueSize = 20
+
+// notifierQueue sends in background so a slow channel doesn't hold the
+// others.
+type notifierQueue struct {
+	Notifier
+	ch chan Notification
+}
+
+var notifiers []*notifierQueue
+
+// initNotifiers builds the telegram bot and the configured notifiers.
+func initNotifiers() {
+	var list []Notifier
+	if config.TelegramBot.Token != "" {
+		list = append(list, telegramNotifier{})
+	}
+	for _, nc := range config.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			logger.Printf("notifications: invalid notifier %s: %s", nc.name(), err)
+			continue
+		}
+		list = append(list, n)
+	}
+
+	notifiers = nil
+	for _, n := range list {
+		q := &notifierQueue{Notifier: n, ch: make(chan Notification, notifierQueueSize)}
+		go q.run()
+		notifiers = append(notifiers, q)
+	}
+}
+
+func (q *notifierQueue) run() {
+	for msg := range q.ch {
+		if err := q.Notify(msg); err != nil {
+			logger.Printf("notifications: error sending to %s: %s", q.Name(), err)
+		}
+	}
+}
+
+// notify throttles and sends a notification.
+func notify(msg Notification) {
+	if len(notifiers) == 0 {
+		return
+	}
+	if msg.Event == "" {
+		msg.Event = eventGeneral
+	}
+	if !notifications.allow(msg) {
+		if config.Debug {
+			logger.Printf("notifications: held %q", msg.Text)
+		}
+		return
+	}
+	dispatch(msg)
+}
+
+// dispatch sends to the notifiers routed to msg.
+func dispatch(msg Notification) {
+	routes := config.Notifications.Routes
+	for _, q := range notifiers {
+		routed := len(routes) == 0
+		for _, r := range routes {
+			if r.match(msg) && contains(r.To, q.Name()) {
+				routed = true
+				break
+			}
+		}
+		if !routed {
+			continue
+		}
+		select {
+		case q.ch <- msg:
+		default:
+			logger.Printf("notifications: %s queue is full, can't send %q", q.Name(), msg.Text)
+		}
+	}
+}
+
+// NotifyLimit allows Max notifications of each source per period.
+type NotifyLimit struct {
+	Max int           `yaml:"max"`
+	Per time.Duration `yaml:"per"`
+}
+
+type heldNotifications struct {
+	count   int
+	sources map[string]bool
+	last    string
+}
+
+type notifyManager struct {
+	mu   sync.Mutex
+	sent map[string][]time.Time // by event and source
+	seen map[string]time.Time   // by event, source and text
+	held map[string]*heldNotifications
+	// start of the current digest period
+	since time.Time
+}
+
+var notifications = &notifyManager{
+	sent:  make(map[string][]time.Time),
+	seen:  make(map[string]time.Time),
+	held:  make(map[string]*heldNotifications),
+	since: time.Now(),
+}
+
+// notifyf sends a notification of an event type, throttled by source.
+func notifyf(event, source, format string, a ...interface{}) {
+	notify(Notification{
+		Text:   fmt.Sprintf(format, a...),
+		Event:  event,
+		Source: source,
+	})
+}
+
+// notifyCriticalf sends a notification bypassing the rate limits and quiet
+// hours. It is still deduplicated.
+func notifyCriticalf(event, source, format string, a ...interface{}) {
+	notify(Notification{
+		Text:     fmt.Sprintf(format, a...),
+		Event:    event,
+		Source:   source,
+		Critical: true,
+	})
+}
+
+func notifyLimit(event string) NotifyLimit {
+	limits := config.Notifications.Limits
+	for _, l := range []NotifyLimit{limits[event], defaultNotifyLimits[event], limits[eventGeneral], defaultNotifyLimits[eventGeneral]} {
+		if l.Max > 0 && l.Per > 0 {
+			return l
+		}
+	}
+	return NotifyLimit{}
+}
+
+func inQuietHours(t time.Time) bool {
+	q := config.Notifications.QuietHours
+	if q == nil || q.Start == q.End {
+		return false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	start, end := midnight.Add(q.Start), midnight.Add(q.End)
+	if q.Start < q.End {
+		return !t.Before(start) && t.Before(end)
+	}
+	return !t.Before(start) || t.Before(end)
+}
+
+// allow tells if a notification can be sent now, holding it for the
+// digest when it can't.
+func (m *notifyManager) allow(msg Notification) bool {
+	now := time.Now()
+	event := msg.Event
+	critical := msg.Critical || contains(config.Notifications.Critical, event)
+
+	dedup := config.Notifications.Dedup
+	if dedup <= 0 {
+		dedup = defaultNotifyDedup
+	}
+	limit := notifyLimit(event)
+	sourceKey := event + "|" + msg.Source
+	textKey := sourceKey + "|" + msg.Text
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, t := range m.seen {
+		if now.Sub(t) >= dedup {
+			delete(m.seen, k)
+		}
+	}
+	sent := m.sent[sourceKey][:0]
+	for _, t := range m.sent[sourceKey] {
+		if now.Sub(t) < limit.Per {
+			sent = append(sent, t)
+		}
+	}
+	m.sent[sourceKey] = sent
+
+	// critical events skip the limits and quiet hours, not the dedup
+	_, hold := m.seen[textKey]
+	if !critical {
+		hold = hold || inQuietHours(now) || (limit.Max > 0 && len(sent) >= limit.Max)
+	}
+	if hold {
+		h, ok := m.held[event]
+		if !ok {
+			h = &heldNotifications{sources: make(map[string]bool)}
+			m.held[event] = h
+		}
+		h.count++
+		if msg.Source != "" {
+			h.sources[msg.Source] = true
+		}
+		h.last = msg.Text
+		return false
+	}
+
+	m.seen[textKey] = now
+	m.sent[sourceKey] = append(sent, now)
+	return true
+}
+
+// digest summarizes the held notifications once a period, after the
+// quiet hours.
+func (m *notifyManager) digest(now time.Time) string {
+	period := config.Notifications.Digest
+	if period <= 0 {
+		period = defaultNotifyDigest
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.held) == 0 {
+		m.since = now
+		return ""
+	}
+	if now.Sub(m.since) < period || inQuietHours(now) {
+		return ""
+	}
+
+	events := make([]string, 0, len(m.held))
+	for event := range m.held {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Notifications held since %s:", m.since.Format("Jan _2 15:04"))
+	for _, event := range events {
+		h := m.held[event]
+		fmt.Fprintf(&b, "\n- %s: %d", event, h.count)
+		if len(h.sources) > 0 {
+			sources := make([]string, 0, len(h.sources))
+			for s := range h.sources {
+				sources = append(sources, s)
+			}
+			sort.Strings(sources)
+			fmt.Fprintf(&b, " from %d sources (%s)", len(sources), strings.Join(sources, ", "))
+		}
+		fmt.Fprintf(&b, ", last: %s", h.last)
+	}
+
+	m.held = make(map[string]*heldNotifications)
+	m.since = now
+	return b.String()
+}
+
+func notificationDigest() {
+	for now := range time.NewTicker(notifyDigestCheck).C {
+		if text := notifications.digest(now); text != "" {
+			logger.Printf("notifications: sending digest")
+			dispatch(Notification{Text: text, Event: eventGeneral})
+		}
+	}
+}
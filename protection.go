@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"vigilantpi/db"
+)
+
+const (
+	protectedKey       = "protected"
+	protectedRangesKey = "protected-ranges"
+)
+
+var (
+	errProtected = errors.New("recording is protected")
+
+	// accepted formats for time ranges, local time
+	timeLayouts = []string{
+		time.RFC3339,
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+	}
+)
+
+// protectedRange protects every recording of a camera overlapping it.
+type protectedRange struct {
+	Camera string    `json:"camera"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+}
+
+func (r protectedRange) String() string {
+	return fmt.Sprintf("%s|%d|%d", r.Camera, r.From.Unix(), r.To.Unix())
+}
+
+func parseProtectedRange(s string) (r protectedRange, ok bool) {
+	parts := strings.Split(s, "|")
+	if len(parts) != 3 {
+		return r, false
+	}
+	from, err1 := strconv.ParseInt(parts[1], 10, 64)
+	to, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return r, false
+	}
+	return protectedRange{Camera: parts[0], From: time.Unix(from, 0), To: time.Unix(to, 0)}, true
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(s), time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use YYYY-MM-DDTHH:MM", s)
+}
+
+// cleanRel returns a path relative to videos dir that can't escape it.
+func cleanRel(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.TrimSpace(p)), "/")
+}
+
+func protectFile(rel string) error {
+	rel = cleanRel(rel)
+	info, err := os.Stat(path.Join(videosDir(), rel))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", rel)
+	}
+	if isProtectedFile(rel) {
+		return nil
+	}
+	return protectionChanged(db.AppendArray(protectedKey, rel))
+}
+
+func unprotectFile(rel string) error {
+	return protectionChanged(db.RemoveFromArray(protectedKey, cleanRel(rel)))
+}
+
+func protectRange(camera string, from, to time.Time) error {
+	if _, ok := cameraConfig(camera); !ok {
+		return fmt.Errorf("unknown camera %q", camera)
+	}
+	if !to.After(from) {
+		return errors.New("invalid time range")
+	}
+	return protectionChanged(db.AppendArray(protectedRangesKey, protectedRange{camera, from, to}.String()))
+}
+
+func unprotectRange(r protectedRange) error {
+	return protectionChanged(db.RemoveFromArray(protectedRangesKey, r.String()))
+}
+
+// protectionChanged updates the indexes in background after a successful
+// change.
+func protectionChanged(err error) error {
+	if err == nil {
+		go refreshProtectedIndex()
+	}
+	return err
+}
+
+func protectedFiles() []string {
+	return db.GetArray(protectedKey)
+}
+
+func protectedRanges() []protectedRange {
+	var ranges []protectedRange
+	for _, s := range db.GetArray(protectedRangesKey) {
+		if r, ok := parseProtectedRange(s); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+func isProtectedFile(rel string) bool {
+	for _, p := range protectedFiles() {
+		if p == rel {
+			return true
+		}
+	}
+	return false
+}
+
+func isProtected(rec recording) bool {
+	if isProtectedFile(rec.rel) {
+		return true
+	}
+	for _, r := range protectedRanges() {
+		if r.Camera == rec.camera && rec.start.Before(r.To) && rec.end.After(r.From) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRemovable fails if rel is, or contains, a protected recording.
+func checkRemovable(rel string) error {
+	rel = cleanRel(rel)
+	return filepath.Walk(path.Join(videosDir(), rel), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		r, _ := filepath.Rel(videosDir(), p)
+		if isProtectedFile(r) {
+			return fmt.Errorf("%s: %w", r, errProtected)
+		}
+		if rec, ok := parseRecording(path.Dir(r), path.Base(r)); ok && isProtected(rec) {
+			return fmt.Errorf("%s: %w", r, errProtected)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queueDirName      = ".queue"
+	quarantineDirName = ".quarantine"
+
+	jobConvert = "convert"
+
+	priorityLow    = 0
+	priorityNormal = 10
+	priorityHigh   = 20
+
+	defaultQueueWorkers     = 1
+	defaultQueueMaxAttempts = 5
+	defaultQueueBackoff     = time.Minute
+	maxQueueBackoff         = time.Hour
+
+	// workers look for retries at least this often
+	queuePollInterval = time.Minute
+)
+
+// Queue ...
+type Queue struct {
+	Workers     int           `yaml:"workers"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+}
+
+// queueJob is persisted as json on the queue dir of the storage holding
+// its file until it succeeds or is quarantined, so pending work survives crashes and power losses.
+type queueJob struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	File      string    `json:"file"`
+	Priority  int       `json:"priority"`
+	Attempts  int       `json:"attempts"`
+	Created   time.Time `json:"created"`
+	NextRun   time.Time `json:"next_run"`
+	LastError string    `json:"last_error,omitempty"`
+
+	running bool
+}
+
+// jobHandlers runs a job by kind. Handlers must be idempotent, a job
+// interrupted by a crash runs again from the start.
+var jobHandlers = map[string]func(job *queueJob) error{
+	jobConvert: func(job *queueJob) error {
+		return convert(job.File)
+	},
+	jobDowngrade: func(job *queueJob) error {
+		return downgrade(job.File)
+	},
+	jobReindex: func(job *queueJob) error {
+		_, err := reindexDay(path.Base(job.File), false)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	},
+}
+
+type jobQueue struct {
+	sync.Mutex
+	jobs    map[string]*queueJob
+	wake    chan struct{}
+	started bool
+}
+
+var queue = &jobQueue{
+	jobs: make(map[string]*queueJob),
+	wake: make(chan struct{}, 1),
+}
+
+func queueDir(s *Storage) string {
+	return path.Join(s.VideosDir, queueDirName)
+}
+
+func quarantineDir(s *Storage) string {
+	return path.Join(s.VideosDir, quarantineDirName)
+}
+
+func jobID(kind, file string) string {
+	sum := sha1.Sum([]byte(kind + "|" + file))
+	return kind + "_" + hex.EncodeToString(sum[:8])
+}
+
+// enqueue adds a job for file, it never blocks the caller.
+// A job already queued for the same kind and file is kept.
+func enqueue(kind, file string, priority int) {
+	id := jobID(kind, file)
+
+	queue.Lock()
+	_, ok := queue.jobs[id]
+	queue.Unlock()
+	if ok {
+		return
+	}
+	now := time.Now()
+	job := &queueJob{
+		ID:       id,
+		Kind:     kind,
+		File:     file,
+		Priority: priority,
+		Created:  now,
+		NextRun:  now,
+	}
+	// saved before being visible to the workers, out of the lock
+	if err := job.save(); err != nil {
+		logger.Printf("queue: error persisting %s job of %s: %s", kind, file, err)
+	}
+
+	queue.Lock()
+	if _, ok := queue.jobs[id]; ok {
+		queue.Unlock()
+		return
+	}
+	queue.jobs[id] = job
+	queue.Unlock()
+	queue.notify()
+}
+
+// startQueue loads the persisted jobs of every mounted storage, queues
+// orphan recordings and starts the workers. Must be called with the hdd
+// mounted.
+func startQueue() {
+	queue.Lock()
+	if queue.started {
+		queue.Unlock()
+		return
+	}
+	queue.started = true
+	queue.Unlock()
+
+	for _, s := range mountedStorages() {
+		loadQueue(s)
+		scanOrphanFiles(s)
+	}
+	queueReindex()
+
+	workers := config.Queue.Workers
+	if workers <= 0 {
+		workers = defaultQueueWorkers
+	}
+	logger.Printf("queue: %d jobs pending, starting %d workers", len(queueStatus().Jobs), workers)
+	for i := 0; i < workers; i++ {
+		go queueWorker()
+	}
+}
+
+func loadQueue(s *Storage) {
+	dir := queueDir(s)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.Printf("queue: error reading %s: %s", dir, err)
+		return
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+	for _, f := range files {
+		file := path.Join(dir, f.Name())
+		if strings.HasPrefix(f.Name(), ".") {
+			// interrupted write, the job is still on the previous version
+			os.Remove(file)
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			logger.Printf("queue: error reading %s: %s", file, err)
+			continue
+		}
+		job := &queueJob{}
+		if err := json.Unmarshal(data, job); err != nil || job.ID == "" {
+			logger.Printf("queue: removing corrupted job %s: %v", file, err)
+			os.Remove(file)
+			continue
+		}
+		if job.path() != file {
+			// queued on the storage recording at the time, moved to the
+			// one holding its file
+			if err := job.save(); err != nil {
+				logger.Printf("queue: error moving job %s: %s", file, err)
+			} else {
+				os.Remove(file)
+			}
+		}
+		queue.jobs[job.ID] = job
+	}
+}
+
+// scanOrphanFiles queues recordings left on the tmp dir without a job,
+// e.g. from versions without the persistent queue.
+func scanOrphanFiles(s *Storage) {
+	tmpDir := path.Join(s.VideosDir, ".tmp")
+	if _, err := os.Stat(tmpDir); os.IsNotExist(err) {
+		return
+	}
+
+	err := filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasPrefix(info.Name(), "rec_") || !strings.HasSuffix(path, ".ts") {
+			return nil
+		}
+		queue.Lock()
+		_, queued := queue.jobs[jobID(jobConvert, path)]
+		queue.Unlock()
+		if !queued {
+			logger.Printf("found orphaned file: %s", path)
+			enqueue(jobConvert, path, priorityNormal)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Printf("error scanning for existing .ts files in .tmp: %s", err)
+	}
+}
+
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next picks the ready job with the highest priority, oldest first.
+// When none is ready it returns how long to wait for the next retry.
+func (q *jobQueue) next() (*queueJob, time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	wait := queuePollInterval
+	var ready []*queueJob
+	for _, job := range q.jobs {
+		if job.running {
+			continue
+		}
+		if job.NextRun.After(now) {
+			if d := job.NextRun.Sub(now); d < wait {
+				wait = d
+			}
+			continue
+		}
+		ready = append(ready, job)
+	}
+	if len(ready) == 0 {
+		return nil, wait
+	}
+
+	sort.Slice(ready, func(i, j int) bool {
+		if ready[i].Priority != ready[j].Priority {
+			return ready[i].Priority > ready[j].Priority
+		}
+		return ready[i].Created.Before(ready[j].Created)
+	})
+	job := ready[0]
+	job.running = true
+	if len(ready) > 1 {
+		// there is more work for other idle workers
+		q.notify()
+	}
+	return job, 0
+}
+
+func queueWorker() {
+	for {
+		job, wait := queue.next()
+		if job == nil {
+			select {
+			case <-queue.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		handler, ok := jobHandlers[job.Kind]
+		var err error
+		if ok {
+			err = handler(job)
+		} else {
+			err = fmt.Errorf("unknown job kind %q", job.Kind)
+		}
+		queue.finish(job, err)
+	}
+}
+
+// finish removes a successful job, schedules a retry with exponential
+// backoff or quarantines the job after too many attempts. Failures while
+// the storage is unhealthy aren't counted as attempts.
+// The job is kept running until its file is written, so no other worker
+// writes it meanwhile.
+func (q *jobQueue) finish(job *queueJob, err error) {
+	if err == nil {
+		if err := os.Remove(job.path()); err != nil && !os.IsNotExist(err) {
+			logger.Printf("queue: error removing job %s: %s", job.ID, err)
+		}
+		q.Lock()
+		delete(q.jobs, job.ID)
+		q.Unlock()
+		return
+	}
+
+	storage := storageOf(job.File)
+	healthy, reason := storage.healthy()
+
+	q.Lock()
+	job.LastError = err.Error()
+	if !healthy {
+		logger.Printf("queue: %s of %s failed while %s is unhealthy (%s), retrying: %s", job.Kind, job.File, storage.Name, reason, err)
+		job.NextRun = time.Now().Add(queuePollInterval)
+	} else {
+		job.Attempts++
+		logger.Printf("queue: %s of %s failed (attempt %d): %s", job.Kind, job.File, job.Attempts, err)
+
+		maxAttempts := config.Queue.MaxAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = defaultQueueMaxAttempts
+		}
+		if job.Attempts >= maxAttempts {
+			delete(q.jobs, job.ID)
+			job.running = false
+			q.Unlock()
+			go quarantine(job)
+			return
+		}
+		job.NextRun = time.Now().Add(queueBackoff(job.Attempts))
+	}
+	data, err := json.MarshalIndent(job, "", "  ")
+	q.Unlock()
+
+	if err == nil {
+		err = writeJob(job.path(), data)
+	}
+	if err != nil {
+		logger.Printf("queue: error persisting job %s: %s", job.ID, err)
+	}
+
+	q.Lock()
+	job.running = false
+	q.Unlock()
+}
+
+func queueBackoff(attempts int) time.Duration {
+	backoff := config.Queue.Backoff
+	if backoff <= 0 {
+		backoff = defaultQueueBackoff
+	}
+	for i := 1; i < attempts && backoff < maxQueueBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxQueueBackoff {
+		backoff = maxQueueBackoff
+	}
+	return backoff
+}
+
+// quarantine moves the file of a failed job out of the way, along with
+// the job describing the failure, for manual inspection.
+// Jobs of other kinds aren't retried while their json is there.
+func quarantine(job *queueJob) {
+	dir := quarantineDir(storageOf(job.File))
+	if err := os.MkdirAll(dir, 0774); err != nil {
+		logger.Printf("queue: error creating %s: %s", dir, err)
+		return
+	}
+
+	dst := path.Join(dir, path.Base(job.File))
+	// only unconverted recordings are moved, the others are still playable
+	if _, err := os.Stat(job.File); err == nil && job.Kind == jobConvert {
+		if err := moveFile(job.File, dst); err != nil {
+			logger.Printf("queue: error moving %s to quarantine: %s", job.File, err)
+		}
+	}
+
+	data, _ := json.MarshalIndent(job, "", "  ")
+	if err := ioutil.WriteFile(dst+".json", data, 0664); err != nil {
+		logger.Printf("queue: error writing %s.json: %s", dst, err)
+	}
+	if err := os.Remove(job.path()); err != nil && !os.IsNotExist(err) {
+		logger.Printf("queue: error removing job %s: %s", job.ID, err)
+	}
+
+	logger.Printf("queue: %s quarantined after %d attempts", job.File, job.Attempts)
+	notifyf(
+		eventRecording, job.Kind,
+		"%s of %s failed %d times and was moved to quarantine: %s",
+		job.Kind, path.Base(job.File), job.Attempts, job.LastError,
+	)
+}
+
+func isQuarantined(file string) bool {
+	_, err := os.Stat(path.Join(quarantineDir(storageOf(file)), path.Base(file)+".json"))
+	return err == nil
+}
+
+func (job *queueJob) path() string {
+	return path.Join(queueDir(storageOf(job.File)), job.ID+".json")
+}
+
+// save writes the job atomically, a crash leaves either the previous or
+// the new version.
+func (job *queueJob) save() error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeJob(job.path(), data)
+}
+
+func writeJob(file string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(file), 0774); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data)
+}
+
+type queueJobInfo struct {
+	queueJob
+	Running bool `json:"running"`
+}
+
+type queueInfo struct {
+	Workers     int            `json:"workers"`
+	Pending     int            `json:"pending"`
+	Running     int            `json:"running"`
+	Retrying    int            `json:"retrying"`
+	Jobs        []queueJobInfo `json:"jobs"`
+	Quarantined []string       `json:"quarantined"`
+}
+
+// queueStatus describes the queue for the api, jobs in processing order.
+func queueStatus() queueInfo {
+	info := queueInfo{
+		Workers:     config.Queue.Workers,
+		Jobs:        []queueJobInfo{},
+		Quarantined: []string{},
+	}
+	if info.Workers <= 0 {
+		info.Workers = defaultQueueWorkers
+	}
+
+	queue.Lock()
+	for _, job := range queue.jobs {
+		info.Jobs = append(info.Jobs, queueJobInfo{queueJob: *job, Running: job.running})
+		switch {
+		case job.running:
+			info.Running++
+		case job.Attempts > 0:
+			info.Retrying++
+		default:
+			info.Pending++
+		}
+	}
+	queue.Unlock()
+
+	sort.Slice(info.Jobs, func(i, j int) bool {
+		a, b := info.Jobs[i], info.Jobs[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.Created.Before(b.Created)
+	})
+
+	for _, s := range mountedStorages() {
+		files, _ := ioutil.ReadDir(quarantineDir(s))
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), ".json") {
+				info.Quarantined = append(info.Quarantined, strings.TrimSuffix(f.Name(), ".json"))
+			}
+		}
+	}
+	return info
+}
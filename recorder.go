@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	recorderFFMPEG  = "ffmpeg"
+	recorderNative  = "native"
+	recorderSegment = "segment"
+
+	segmentTimeLayout = dayDirLayout + "-15_04_05"
+)
+
+// segmentName returns the tmp file name of a segment started at t.
+// The converter relies on this format.
+func segmentName(c *Camera, t time.Time) string {
+	return t.Format(dayDirLayout) + "-" + t.Format("15_04_05_") + c.Name + "." + c.targetExt() + ".ts"
+}
+
+// segmentStart parses the start time from a segment name.
+func segmentStart(name string) (time.Time, error) {
+	if len(name) < len(segmentTimeLayout) {
+		return time.Time{}, fmt.Errorf("invalid segment name %s", name)
+	}
+	return time.ParseInLocation(segmentTimeLayout, name[:len(segmentTimeLayout)], time.Local)
+}
+
+// segmentRecorded hands a finished segment to the converter and runs the
+// after_rec tasks.
+func (c *Camera) segmentRecorded(filePath string, start time.Time) {
+	segmentDone(c.Name, filePath, start)
+	enqueue(jobConvert, filePath, priorityNormal)
+
+	c.RunAfterRecTasks(map[string]string{
+		"file_path":      filePath,
+		"file_name":      path.Base(filePath),
+		"camera_name":    c.Name,
+		"start_time":     start.Format("15:04:05"),
+		"start_date":     start.Format("2006-01-02"),
+		"start_datetime": start.Format("2006-01-02 15:04:05"),
+	})
+}
+
+// openSource reads the camera from its relay when there is one.
+func (c *Camera) openSource(ctx context.Context) (videoSource, error) {
+	if r, ok := relayFor(c.Name); ok {
+		return r.subscribe(), nil
+	}
+	return dialRTSP(ctx, c.URL, c.Timeout)
+}
+
+// recordNative keeps a single rtsp session open and cuts it into segments
+// of `duration` on keyframes. It returns when ctx is done or the stream fails.
+func recordNative(ctx context.Context, c *Camera, tmpDir string) error {
+	s, err := c.openSource(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	logger.Printf("native recorder connected to %s", c.Name)
+
+	var (
+		f        *os.File
+		w        *bufio.Writer
+		mux      *tsMuxer
+		segStart time.Time
+		firstPTS int64
+	)
+
+	closeSegment := func() {
+		if f == nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			logger.Printf("error writing segment %s: %s", f.Name(), err)
+		}
+		if err := f.Close(); err != nil {
+			logger.Printf("error closing segment %s: %s", f.Name(), err)
+		}
+		logger.Printf("segment %s finished", f.Name())
+		c.segmentRecorded(f.Name(), segStart)
+		f = nil
+	}
+	defer closeSegment()
+
+	return s.ReadAccessUnits(ctx, func(au *accessUnit) error {
+		if f == nil && !au.key {
+			// segments always start on a keyframe
+			return nil
+		}
+
+		if au.key && (f == nil || time.Since(segStart) >= duration) {
+			closeSegment()
+
+			segStart = time.Now()
+			filePath := path.Join(tmpDir, segmentName(c, segStart))
+			var err error
+			if f, err = os.Create(filePath); err != nil {
+				return err
+			}
+			logger.Printf("recording segment %s", filePath)
+			w = bufio.NewWriterSize(f, 256*1024)
+			mux = newTSMuxer(w, s.Codec())
+			firstPTS = au.pts
+		}
+
+		return mux.WriteAccessUnit(au, au.pts-firstPTS)
+	})
+}
+
+// recordSegments runs a single long lived ffmpeg using the segment muxer.
+// Completed segments are read from the segment list and sent to the
+// converter, so the stream is only reconnected when ffmpeg fails.
+func recordSegments(ctx context.Context, c *Camera, tmpDir string) error {
+	start := time.Now()
+	listPath := path.Join(tmpDir, "."+c.Name+".segments")
+	if err := os.Remove(listPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// names must match segmentName, % is escaped because of -strftime
+	pattern := "rec_%Y_%m_%d-%H_%M_%S_" + strings.ReplaceAll(c.Name+"."+c.targetExt(), "%", "%%") + ".ts"
+
+	args := append(
+		c.ffmpegArgs(),
+		"-f", "segment",
+		"-segment_format", "mpegts",
+		"-segment_time", strconv.Itoa(int(duration.Seconds())),
+		"-segment_list", listPath,
+		"-segment_list_type", "flat",
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		path.Join(tmpDir, pattern),
+	)
+
+	signals := make(chan syscall.Signal, 1)
+	defer close(signals)
+
+	finished := make(chan error, 1)
+	go func() {
+		finished <- execProcess(ffmpeg, args, signals)
+	}()
+
+	// the list only grows, so it is read from where the last read ended
+	// and the last pushed segment is enough to skip the listed ones
+	var (
+		listOffset int
+		last       string
+	)
+	push := func(filePath string) {
+		segStart, err := segmentStart(path.Base(filePath))
+		if err != nil {
+			segStart = start
+		}
+		last = path.Base(filePath)
+		logger.Printf("segment %s finished", filePath)
+		c.segmentRecorded(filePath, segStart)
+	}
+
+	collect := func(final bool) {
+		if b, err := os.ReadFile(listPath); err == nil && len(b) > listOffset {
+			b = b[listOffset:]
+			// a line without newline is still being written
+			n := strings.LastIndexByte(string(b), '\n') + 1
+			listOffset += n
+			for _, line := range strings.Split(string(b[:n]), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					push(path.Join(tmpDir, path.Base(line)))
+				}
+			}
+		}
+		if !final {
+			return
+		}
+
+		// the segment being written when ffmpeg stopped may not be listed
+		files, _ := ioutil.ReadDir(tmpDir)
+		for _, info := range files {
+			name := info.Name()
+			t, err := segmentStart(name)
+			if err != nil || name != segmentName(c, t) || name <= last || info.ModTime().Before(start) {
+				continue
+			}
+			push(path.Join(tmpDir, name))
+		}
+	}
+
+	t := time.NewTicker(time.Second * 5)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			signals <- syscall.SIGINT
+			logger.Printf("SIGINT sent to %s", c.Name)
+
+			var err error
+			select {
+			case err = <-finished:
+			case <-time.After(config.TerminationTimeout):
+				signals <- syscall.SIGKILL
+				logger.Printf("SIGKILL sent to %s", c.Name)
+				err = <-finished
+			}
+			collect(true)
+			return err
+
+		case err := <-finished:
+			collect(true)
+			return err
+
+		case <-t.C:
+			collect(false)
+		}
+	}
+}
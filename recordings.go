@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	recordingTimeLayout = "15_04_05_"
+)
+
+// recording is a converted video inside a day directory.
+// Its name has the format HH_MM_SS_camera.ext or timelapse_camera.mp4
+type recording struct {
+	path      string
+	rel       string
+	camera    string
+	start     time.Time
+	end       time.Time
+	size      int64
+	timelapse bool
+
+	// only known when read from the day index
+	duration float64
+	codec    string
+	width    int
+	height   int
+	motion   int
+}
+
+// dir returns the videos dir holding the recording.
+func (rec recording) dir() string {
+	return path.Dir(path.Dir(rec.path))
+}
+
+func parseRecording(dayDir, name string) (rec recording, ok bool) {
+	day, err := time.ParseInLocation(dayDirLayout, dayDir, time.Local)
+	if err != nil || len(name) <= len(recordingTimeLayout) || isSidecar(name) {
+		return rec, false
+	}
+
+	if strings.HasPrefix(name, timelapsePrefix) {
+		return recording{
+			path:      path.Join(videosDir(), dayDir, name),
+			rel:       path.Join(dayDir, name),
+			camera:    strings.TrimSuffix(strings.TrimPrefix(name, timelapsePrefix), ".mp4"),
+			start:     day,
+			end:       day.AddDate(0, 0, 1),
+			timelapse: true,
+		}, true
+	}
+
+	clock, err := time.Parse(recordingTimeLayout, name[:len(recordingTimeLayout)])
+	if err != nil {
+		return rec, false
+	}
+
+	camera := name[len(recordingTimeLayout):]
+	if i := strings.LastIndex(camera, "."); i > 0 {
+		camera = camera[:i]
+	}
+
+	rec = recording{
+		path:   path.Join(videosDir(), dayDir, name),
+		rel:    path.Join(dayDir, name),
+		camera: camera,
+		start: time.Date(
+			day.Year(), day.Month(), day.Day(),
+			clock.Hour(), clock.Minute(), clock.Second(), 0,
+			time.Local,
+		),
+	}
+	// estimated, the real end is on the day index
+	rec.end = rec.start.Add(duration)
+	return rec, true
+}
+
+// listRecordings returns every recording on a videos dir, oldest first.
+func listRecordings(dir string) ([]recording, error) {
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []recording
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(dayDirLayout, d.Name()); err != nil {
+			continue
+		}
+
+		dayRecs, err := dayRecordings(dir, d.Name())
+		if err != nil {
+			logger.Printf("error listing %s: %s", d.Name(), err)
+			continue
+		}
+		recs = append(recs, dayRecs...)
+	}
+
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].start.Before(recs[j].start)
+	})
+	return recs, nil
+}
+
+// listDays returns the day directories, newest first.
+func listDays() ([]string, error) {
+	dirs, err := ioutil.ReadDir(videosDir())
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if !dirs[i].IsDir() {
+			continue
+		}
+		if _, err := time.Parse(dayDirLayout, dirs[i].Name()); err == nil {
+			days = append(days, dirs[i].Name())
+		}
+	}
+	return days, nil
+}
+
+// dayRecordings lists the recordings of a single day directory from its
+// index. Files not indexed yet are described from their names and the
+// day is queued to be indexed.
+func dayRecordings(dir, dayDir string) ([]recording, error) {
+	files, err := ioutil.ReadDir(path.Join(dir, dayDir))
+	if err != nil {
+		return nil, err
+	}
+	idx, err := readDayIndex(dir, dayDir)
+	if err != nil {
+		logger.Printf("index: error reading %s: %s", indexPath(dir, dayDir), err)
+		idx = &dayIndex{}
+	}
+
+	var recs []recording
+	var missing bool
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if e, ok := idx.find(f.Name()); ok {
+			rec := e.recording(dir, dayDir)
+			rec.size = f.Size()
+			recs = append(recs, rec)
+			continue
+		}
+		if rec, ok := parseRecording(dayDir, f.Name()); ok {
+			rec.path = path.Join(dir, rec.rel)
+			rec.size = f.Size()
+			recs = append(recs, rec)
+			missing = missing || time.Since(f.ModTime()) > reindexMinAge
+		}
+	}
+	// days of other storages are indexed when migrated
+	if missing && dir == videosDir() {
+		enqueue(jobReindex, path.Join(dir, dayDir), priorityLow)
+	}
+
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].start.Before(recs[j].start)
+	})
+	return recs, nil
+}
+
+type recordingInfo struct {
+	File       string    `json:"file"`
+	Camera     string    `json:"camera"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Duration   float64   `json:"duration,omitempty"`
+	Size       int64     `json:"size"`
+	Codec      string    `json:"codec,omitempty"`
+	Width      int       `json:"width,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	Motion     int       `json:"motion"`
+	Timelapse  bool      `json:"timelapse,omitempty"`
+	Protected  bool      `json:"protected"`
+	URL        string    `json:"url"`
+	Poster     string    `json:"poster,omitempty"`
+	Sprite     string    `json:"sprite,omitempty"`
+	Thumbnails string    `json:"thumbnails,omitempty"`
+}
+
+// info describes the recording for the api and the recordings browser.
+// Urls are served by the admin server.
+func (rec recording) info() recordingInfo {
+	videoURL := func(rel string) string {
+		return (&url.URL{Path: "/videos/" + rel}).String()
+	}
+	exists := func(suffix string) bool {
+		_, err := os.Stat(rec.path + suffix)
+		return err == nil
+	}
+
+	i := recordingInfo{
+		File:      rec.rel,
+		Camera:    rec.camera,
+		Start:     rec.start,
+		End:       rec.end,
+		Duration:  rec.duration,
+		Size:      rec.size,
+		Codec:     rec.codec,
+		Width:     rec.width,
+		Height:    rec.height,
+		Motion:    rec.motion,
+		Timelapse: rec.timelapse,
+		Protected: isProtected(rec),
+		URL:       videoURL(rec.rel),
+	}
+	if exists(posterSuffix) {
+		i.Poster = videoURL(rec.rel + posterSuffix)
+	}
+	if exists(spriteSuffix) {
+		i.Sprite = videoURL(rec.rel + spriteSuffix)
+	}
+	if exists(vttSuffix) {
+		i.Thumbnails = videoURL(rec.rel + vttSuffix)
+	}
+	return i
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	relayQueueSize = 512
+
+	subRelaySuffix = "/sub"
+)
+
+var (
+	relayByName = make(map[string]*relay)
+
+	errRelayClosed = errors.New("relay: subscriber closed")
+)
+
+// videoSource delivers the access units of a camera stream.
+type videoSource interface {
+	Codec() string
+	ReadAccessUnits(ctx context.Context, fn func(au *accessUnit) error) error
+	Close() error
+}
+
+// relay keeps a single upstream rtsp session of a camera and fans its
+// access units out to any number of subscribers.
+type relay struct {
+	name    string
+	url     string
+	timeout time.Duration
+
+	// closed once the upstream was first described
+	probed    chan struct{}
+	probeOnce sync.Once
+
+	mu          sync.Mutex
+	codec       string
+	unsupported bool
+	subs        map[*relaySub]struct{}
+}
+
+type relaySub struct {
+	r   *relay
+	aus chan *accessUnit
+}
+
+func startRelays() {
+	if !config.Relay.Enabled {
+		return
+	}
+
+	add := func(name, rawURL string, timeout time.Duration) {
+		if !strings.HasPrefix(rawURL, "rtsp://") {
+			logger.Printf("relay: %s is not rtsp, won't be relayed", name)
+			return
+		}
+		r := &relay{
+			name:    name,
+			url:     rawURL,
+			timeout: timeout,
+			probed:  make(chan struct{}),
+			subs:    make(map[*relaySub]struct{}),
+		}
+		relayByName[name] = r
+		go r.run()
+	}
+
+	for _, c := range config.Cameras {
+		if c.Disabled {
+			continue
+		}
+		// audio isn't relayed, ffmpeg must read it from the camera
+		if c.Audio {
+			logger.Printf("relay: %s records audio, won't be relayed", c.Name)
+		} else {
+			add(c.Name, c.URL, c.Timeout)
+		}
+		if c.SubURL != "" {
+			add(c.Name+subRelaySuffix, c.SubURL, c.Timeout)
+		}
+	}
+
+	go relayServer()
+}
+
+// relayFor returns the relay of a camera stream, unless the stream isn't
+// relayed or its codec can't be relayed.
+func relayFor(name string) (*relay, bool) {
+	r, ok := relayByName[name]
+	if !ok || !r.usable() {
+		return nil, false
+	}
+	return r, true
+}
+
+func relayAddr() string {
+	if config.Relay.Addr == "" {
+		return ":8554"
+	}
+	return config.Relay.Addr
+}
+
+func relayServer() {
+	addr := relayAddr()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live/", relayHandler)
+
+	// local consumers don't authenticate, so the credentials don't end up
+	// on command lines
+	protected := auth(config.Admin.User, config.Admin.Pass, mux)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+				mux.ServeHTTP(w, r)
+				return
+			}
+		}
+		protected.ServeHTTP(w, r)
+	})
+
+	logger.Printf("starting relay server on %s", addr)
+	err := http.ListenAndServe(addr, handler)
+	if err != nil {
+		logger.Printf("error on relay server: %s", err)
+	}
+}
+
+// relayURL is the address local consumers use to read a relayed camera.
+func relayURL(name string) string {
+	_, port, _ := net.SplitHostPort(relayAddr())
+
+	u := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort("127.0.0.1", port),
+		Path:   "/live/" + name + ".ts",
+	}
+	return u.String()
+}
+
+// serverLive lists the relay address of each camera.
+func serverLive() string {
+	if len(relayByName) == 0 {
+		return "relay is disabled"
+	}
+	_, port, _ := net.SplitHostPort(relayAddr())
+
+	var lines []string
+	for _, c := range config.Cameras {
+		for _, name := range []string{c.Name, c.Name + subRelaySuffix} {
+			if _, ok := relayFor(name); ok {
+				lines = append(lines, fmt.Sprintf("%s: http://%s/live/%s.ts", name, net.JoinHostPort(localIP(), port), name))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// relayHandler streams a camera as mpeg-ts over http, starting on the
+// next keyframe.
+func relayHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/live/"), ".ts")
+	rl, ok := relayFor(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	sub := rl.subscribe()
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	flusher, _ := w.(http.Flusher)
+
+	var (
+		mux      *tsMuxer
+		firstPTS int64
+	)
+	err := sub.ReadAccessUnits(r.Context(), func(au *accessUnit) error {
+		if mux == nil {
+			if !au.key {
+				return nil
+			}
+			mux = newTSMuxer(w, sub.Codec())
+			firstPTS = au.pts
+		}
+		if err := mux.WriteAccessUnit(au, au.pts-firstPTS); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		logger.Printf("relay: %s client %s disconnected: %s", name, r.RemoteAddr, err)
+	}
+}
+
+func (r *relay) run() {
+	var last int64
+	for {
+		err := func() error {
+			s, err := dialRTSP(context.Background(), r.url, r.timeout)
+			if errors.Is(err, errNoVideoTrack) {
+				r.mu.Lock()
+				r.unsupported = true
+				r.mu.Unlock()
+			}
+			r.probeOnce.Do(func() { close(r.probed) })
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+
+			r.mu.Lock()
+			r.codec = s.Codec()
+			r.mu.Unlock()
+
+			logger.Printf("relay: connected to %s (%s)", r.name, s.Codec())
+
+			// keeps timestamps monotonic across reconnections
+			offset, first := int64(0), true
+			return s.ReadAccessUnits(context.Background(), func(au *accessUnit) error {
+				if first {
+					offset = last + 3000 - au.pts
+					first = false
+				}
+				au.pts += offset
+				last = au.pts
+				r.broadcast(au)
+				return nil
+			})
+		}()
+		if !r.supported() {
+			logger.Printf("relay: %s: %s, won't be relayed", r.name, err)
+			return
+		}
+		logger.Printf("relay: %s upstream closed: %v", r.name, err)
+		time.Sleep(time.Second * 5)
+	}
+}
+
+// usable waits for the upstream to be described, so consumers starting
+// along with the relay don't read a stream it can't handle. An upstream
+// that isn't reachable yet is assumed to be supported.
+func (r *relay) usable() bool {
+	timeout := r.timeout
+	if timeout <= 0 {
+		timeout = rtspDefaultTimeout
+	}
+	select {
+	case <-r.probed:
+		return r.supported()
+	case <-time.After(timeout):
+		return true
+	}
+}
+
+func (r *relay) supported() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.unsupported
+}
+
+func (r *relay) broadcast(au *accessUnit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for sub := range r.subs {
+		select {
+		case sub.aus <- au:
+		default:
+			// too slow, drop it
+			logger.Printf("relay: %s subscriber is too slow, dropping it", r.name)
+			delete(r.subs, sub)
+			close(sub.aus)
+		}
+	}
+}
+
+func (r *relay) subscribe() *relaySub {
+	sub := &relaySub{
+		r:   r,
+		aus: make(chan *accessUnit, relayQueueSize),
+	}
+	r.mu.Lock()
+	r.subs[sub] = struct{}{}
+	r.mu.Unlock()
+	return sub
+}
+
+func (s *relaySub) Codec() string {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	return s.r.codec
+}
+
+// ReadAccessUnits fails if the upstream doesn't deliver anything in time.
+func (s *relaySub) ReadAccessUnits(ctx context.Context, fn func(au *accessUnit) error) error {
+	timeout := s.r.timeout
+	if timeout <= 0 {
+		timeout = rtspDefaultTimeout
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-t.C:
+			return errors.New("relay: no data from upstream")
+
+		case au, ok := <-s.aus:
+			if !ok {
+				return errRelayClosed
+			}
+			if err := fn(au); err != nil {
+				return err
+			}
+			t.Reset(timeout)
+		}
+	}
+}
+
+func (s *relaySub) Close() error {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	if _, ok := s.r.subs[s]; ok {
+		delete(s.r.subs, s)
+		close(s.aus)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"vigilantpi/db"
+)
+
+const (
+	retentionInterval = time.Minute * 10
+
+	defaultDeleteAfterDays = 20
+
+	// kept free over a storage min_free_bytes by retention and migrations,
+	// so recording doesn't fail over between retention runs
+	storageHeadroom = ByteSize(1 << 30)
+)
+
+// Retention ...
+type Retention struct {
+	MinFreePercent  float64  `yaml:"min_free_percent"`
+	MinFreeBytes    ByteSize `yaml:"min_free_bytes"`
+	MaxTotalBytes   ByteSize `yaml:"max_total_bytes"`
+	DeleteAfterDays int      `yaml:"delete_after_days"`
+	KeepMotionDays  int      `yaml:"keep_motion_days"`
+}
+
+func diskUsage(dir string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
+
+// recordMotion saves a motion event so the recording holding it can be
+// kept longer.
+func recordMotion(camera string, t time.Time) {
+	if err := db.AppendArray("motion", camera+"|"+strconv.FormatInt(t.Unix(), 10)); err != nil {
+		logger.Printf("error saving motion event: %s", err)
+	}
+}
+
+func motionEvents() map[string][]time.Time {
+	events := make(map[string][]time.Time)
+	for _, e := range db.GetArray("motion") {
+		i := strings.LastIndex(e, "|")
+		if i == -1 {
+			continue
+		}
+		ts, err := strconv.ParseInt(e[i+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		events[e[:i]] = append(events[e[:i]], time.Unix(ts, 0))
+	}
+	return events
+}
+
+// pruneMotionEvents drops events no recording could still be using.
+func pruneMotionEvents(before time.Time) {
+	var kept []string
+	all := db.GetArray("motion")
+	for _, e := range all {
+		i := strings.LastIndex(e, "|")
+		if i == -1 {
+			continue
+		}
+		if ts, err := strconv.ParseInt(e[i+1:], 10, 64); err == nil && time.Unix(ts, 0).After(before) {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) != len(all) {
+		db.SetArray("motion", kept)
+	}
+}
+
+type retentionCandidate struct {
+	recording
+	motion bool
+	keep   time.Time // motion recordings are kept until then
+}
+
+// storageRetention is the retention block of a storage, the global one
+// when not set. delete_after_days is kept for compatibility.
+func storageRetention(s *Storage) Retention {
+	r := config.Retention
+	if s.Retention != nil {
+		r = *s.Retention
+	}
+	if r.DeleteAfterDays <= 0 {
+		r.DeleteAfterDays = config.DeleteAfterDays
+	}
+	// keeps the storage above its failover floor
+	if s.MinFreeBytes > 0 && s.MinFreeBytes+storageHeadroom > r.MinFreeBytes {
+		r.MinFreeBytes = s.MinFreeBytes + storageHeadroom
+	}
+	return r
+}
+
+func (c *Camera) retention(s *Storage) Retention {
+	r := storageRetention(s)
+	if c.Retention == nil {
+		r.MaxTotalBytes = 0
+		return r
+	}
+	r.MaxTotalBytes = c.Retention.MaxTotalBytes
+	if c.Retention.DeleteAfterDays > 0 {
+		r.DeleteAfterDays = c.Retention.DeleteAfterDays
+	}
+	if c.Retention.KeepMotionDays > 0 {
+		r.KeepMotionDays = c.Retention.KeepMotionDays
+	}
+	return r
+}
+
+// enforceRetention runs the retention of every mounted storage, the ones
+// not in use included, so they can take the recordings again.
+func enforceRetention() {
+	maxDays := defaultDeleteAfterDays
+	failed := false
+	for _, s := range mountedStorages() {
+		days, err := enforceStorageRetention(s)
+		if err != nil {
+			logger.Printf("retention: error listing recordings of %s: %s", s.Name, err)
+			failed = true
+			continue
+		}
+		if days > maxDays {
+			maxDays = days
+		}
+	}
+	// events may still be used by the recordings not listed
+	if !failed {
+		pruneMotionEvents(time.Now().AddDate(0, 0, -maxDays-1))
+	}
+}
+
+// enforceStorageRetention deletes recordings file by file, oldest first,
+// until age, per camera size, total size and free space limits are met.
+// Protected recordings are never deleted. Returns the longest time in
+// days a recording is kept.
+func enforceStorageRetention(s *Storage) (int, error) {
+	maxDays := defaultDeleteAfterDays
+	recs, err := listRecordings(s.VideosDir)
+	if os.IsNotExist(err) {
+		return maxDays, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	events := motionEvents()
+
+	cameraRetention := func(name string) Retention {
+		if c, ok := cameraConfig(name); ok {
+			return c.retention(s)
+		}
+		r := storageRetention(s)
+		r.MaxTotalBytes = 0
+		return r
+	}
+
+	var (
+		candidates []*retentionCandidate
+		total      int64
+	)
+
+	for _, rec := range recs {
+		if isProtected(rec) {
+			continue
+		}
+		r := cameraRetention(rec.camera)
+
+		cand := &retentionCandidate{recording: rec, motion: rec.motion > 0}
+		for _, e := range events[rec.camera] {
+			if cand.motion {
+				break
+			}
+			cand.motion = !e.Before(rec.start) && e.Before(rec.end)
+		}
+		if cand.motion && r.KeepMotionDays > 0 {
+			cand.keep = rec.start.AddDate(0, 0, r.KeepMotionDays)
+		}
+
+		days := r.DeleteAfterDays
+		if days <= 0 {
+			days = defaultDeleteAfterDays
+		}
+		if days > maxDays {
+			maxDays = days
+		}
+		if r.KeepMotionDays > maxDays {
+			maxDays = r.KeepMotionDays
+		}
+		expire := rec.start.AddDate(0, 0, days)
+		if cand.keep.After(expire) {
+			expire = cand.keep
+		}
+		if expire.Before(now) {
+			deleteRecording(rec, "expired")
+			continue
+		}
+
+		total += rec.size
+		candidates = append(candidates, cand)
+	}
+
+	// per camera size limits
+	byCamera := make(map[string][]*retentionCandidate)
+	for _, cand := range candidates {
+		byCamera[cand.camera] = append(byCamera[cand.camera], cand)
+	}
+	for name, cands := range byCamera {
+		limit := int64(cameraRetention(name).MaxTotalBytes)
+		if limit <= 0 {
+			continue
+		}
+		var camTotal int64
+		for _, cand := range cands {
+			camTotal += cand.size
+		}
+		freeUp(cands, func() bool {
+			return camTotal <= limit
+		}, func(cand *retentionCandidate) {
+			camTotal -= cand.size
+			total -= cand.size
+		}, "camera size limit")
+	}
+
+	// global limits
+	r := storageRetention(s)
+	freeUp(candidates, func() bool {
+		if r.MaxTotalBytes > 0 && total > int64(r.MaxTotalBytes) {
+			return false
+		}
+		if r.MinFreeBytes <= 0 && r.MinFreePercent <= 0 {
+			return true
+		}
+		free, size, err := diskUsage(s.VideosDir)
+		if err != nil {
+			logger.Printf("retention: can't check free space: %s", err)
+			return true
+		}
+		if r.MinFreeBytes > 0 && free < uint64(r.MinFreeBytes) {
+			return false
+		}
+		if r.MinFreePercent > 0 && size > 0 && float64(free)*100/float64(size) < r.MinFreePercent {
+			return false
+		}
+		return true
+	}, func(cand *retentionCandidate) {
+		total -= cand.size
+	}, "storage limit")
+
+	removeEmptyDayDirs(s.VideosDir)
+	return maxDays, nil
+}
+
+// freeUp deletes candidates until done returns true. Motion recordings
+// still in their keep period are only deleted if nothing else is left.
+func freeUp(cands []*retentionCandidate, done func() bool, deleted func(*retentionCandidate), reason string) {
+	now := time.Now()
+	for _, keepMotion := range []bool{true, false} {
+		for _, cand := range cands {
+			if done() {
+				return
+			}
+			if cand.size < 0 {
+				// already deleted
+				continue
+			}
+			if keepMotion && cand.motion && cand.keep.After(now) {
+				continue
+			}
+			if deleteRecording(cand.recording, reason) {
+				deleted(cand)
+				cand.size = -1
+			}
+		}
+	}
+}
+
+func deleteRecording(rec recording, reason string) bool {
+	logger.Printf("retention: deleting %s (%s)", rec.rel, reason)
+	if err := os.Remove(rec.path); err != nil {
+		logger.Printf("retention: error deleting %s: %s", rec.rel, err)
+		return false
+	}
+	removeSidecars(rec.path)
+	removeFromIndex(rec)
+	return true
+}
+
+func removeEmptyDayDirs(dir string) {
+	today := time.Now().Format(dayDirLayout)
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || d.Name() == today {
+			continue
+		}
+		if _, err := time.Parse(dayDirLayout, d.Name()); err != nil {
+			continue
+		}
+		dayDir := path.Join(dir, d.Name())
+		files, err := ioutil.ReadDir(dayDir)
+		if err != nil {
+			continue
+		}
+		if len(files) == 1 && files[0].Name() == indexFileName {
+			// index of recordings already deleted
+			os.Remove(path.Join(dayDir, indexFileName))
+			files = nil
+		}
+		if len(files) == 0 {
+			logger.Printf("retention: removing empty %s", d.Name())
+			os.Remove(dayDir)
+		}
+	}
+}
@@ -0,0 +1,791 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	codecH264 = "h264"
+	codecH265 = "h265"
+
+	rtspDefaultTimeout = time.Second * 10
+)
+
+var errNoVideoTrack = errors.New("no h264/h265 video track found")
+
+// accessUnit is a decoded video frame made of one or more NAL units.
+// pts is expressed in 90kHz units since the beginning of the session.
+type accessUnit struct {
+	pts   int64
+	key   bool
+	nalus [][]byte
+}
+
+type rtspTrack struct {
+	codec       string
+	payloadType uint8
+	control     string
+	params      [][]byte
+}
+
+type rtspResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// rtspSession is a minimal RTSP client. It receives the first H.264/H.265
+// video track of a camera using RTP interleaved over the RTSP connection.
+type rtspSession struct {
+	u       *url.URL
+	conn    net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	wmu     sync.Mutex
+	cseq    int
+	session string
+	auth    func(method, uri string) string
+
+	keepalive time.Duration
+	track     *rtspTrack
+}
+
+func dialRTSP(ctx context.Context, rawURL string, timeout time.Duration) (*rtspSession, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	if timeout <= 0 {
+		timeout = rtspDefaultTimeout
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &rtspSession{
+		u:         u,
+		conn:      conn,
+		br:        bufio.NewReaderSize(conn, 64*1024),
+		timeout:   timeout,
+		keepalive: time.Second * 30,
+	}
+
+	if err := s.setup(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *rtspSession) Close() error {
+	return s.conn.Close()
+}
+
+func (s *rtspSession) Codec() string {
+	return s.track.codec
+}
+
+// requestURL returns the session url without credentials.
+func (s *rtspSession) requestURL() string {
+	u := *s.u
+	u.User = nil
+	return u.String()
+}
+
+func (s *rtspSession) setup() error {
+	res, err := s.do("DESCRIBE", s.requestURL(), map[string]string{
+		"Accept": "application/sdp",
+	})
+	if err != nil {
+		return err
+	}
+
+	track, err := parseSDP(res.body)
+	if err != nil {
+		return err
+	}
+	s.track = track
+
+	base := res.header.Get("Content-Base")
+	if base == "" {
+		base = res.header.Get("Content-Location")
+	}
+	if base == "" {
+		base = s.requestURL()
+	}
+
+	res, err = s.do("SETUP", controlURL(base, track.control), map[string]string{
+		"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1",
+	})
+	if err != nil {
+		return err
+	}
+
+	sess := res.header.Get("Session")
+	if i := strings.Index(sess, ";"); i != -1 {
+		for _, opt := range strings.Split(sess[i+1:], ";") {
+			kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+			if len(kv) == 2 && kv[0] == "timeout" {
+				if t, err := strconv.Atoi(kv[1]); err == nil && t > 0 {
+					s.keepalive = time.Duration(t) * time.Second / 2
+				}
+			}
+		}
+		sess = sess[:i]
+	}
+	s.session = strings.TrimSpace(sess)
+
+	_, err = s.do("PLAY", base, map[string]string{
+		"Range": "npt=0.000-",
+	})
+	return err
+}
+
+func controlURL(base, control string) string {
+	if control == "" || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(control, "rtsp://") {
+		return control
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + control
+}
+
+func (s *rtspSession) write(method, uri string, header map[string]string) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(&b, "CSeq: %d\r\n", s.cseq)
+	b.WriteString("User-Agent: VigilantPI\r\n")
+	if s.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", s.session)
+	}
+	if s.auth != nil {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", s.auth(method, uri))
+	}
+	for k, v := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	_, err := io.WriteString(s.conn, b.String())
+	return err
+}
+
+func (s *rtspSession) do(method, uri string, header map[string]string) (*rtspResponse, error) {
+	for try := 0; ; try++ {
+		if err := s.write(method, uri, header); err != nil {
+			return nil, err
+		}
+
+		res, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if res.status == 401 && try == 0 && s.u.User != nil {
+			if err := s.setAuth(res.header.Values("Www-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if res.status != 200 {
+			return nil, fmt.Errorf("rtsp %s: unexpected status %d", method, res.status)
+		}
+		return res, nil
+	}
+}
+
+// readResponse reads the next rtsp response, discarding interleaved frames.
+func (s *rtspSession) readResponse() (*rtspResponse, error) {
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+		first, err := s.br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] == '$' {
+			if _, _, err := s.readFrame(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		tp := textproto.NewReader(s.br)
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+			return nil, fmt.Errorf("bad rtsp status line: %q", line)
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad rtsp status line: %q", line)
+		}
+
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		res := &rtspResponse{status: status, header: header}
+		if cl, _ := strconv.Atoi(header.Get("Content-Length")); cl > 0 {
+			res.body = make([]byte, cl)
+			if _, err := io.ReadFull(s.br, res.body); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+}
+
+func (s *rtspSession) readFrame() (channel byte, payload []byte, err error) {
+	var h [4]byte
+	if _, err = io.ReadFull(s.br, h[:]); err != nil {
+		return
+	}
+	channel = h[1]
+	payload = make([]byte, binary.BigEndian.Uint16(h[2:]))
+	_, err = io.ReadFull(s.br, payload)
+	return
+}
+
+func (s *rtspSession) setAuth(challenges []string) error {
+	user := s.u.User.Username()
+	pass, _ := s.u.User.Password()
+
+	for _, ch := range challenges {
+		if !strings.HasPrefix(ch, "Digest ") {
+			continue
+		}
+		params := parseAuthParams(strings.TrimPrefix(ch, "Digest "))
+		realm, nonce := params["realm"], params["nonce"]
+		ha1 := md5hex(user + ":" + realm + ":" + pass)
+		s.auth = func(method, uri string) string {
+			response := md5hex(ha1 + ":" + nonce + ":" + md5hex(method+":"+uri))
+			return fmt.Sprintf(
+				`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+				user, realm, nonce, uri, response,
+			)
+		}
+		return nil
+	}
+
+	for _, ch := range challenges {
+		if strings.HasPrefix(ch, "Basic") {
+			token := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+			s.auth = func(string, string) string {
+				return "Basic " + token
+			}
+			return nil
+		}
+	}
+
+	return errors.New("rtsp: unsupported authentication method")
+}
+
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		params[strings.ToLower(parts[0])] = strings.Trim(parts[1], `"`)
+	}
+	return params
+}
+
+func md5hex(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+// ReadAccessUnits blocks receiving video until ctx is done or the stream
+// fails. Each complete access unit is passed to fn.
+func (s *rtspSession) ReadAccessUnits(ctx context.Context, fn func(au *accessUnit) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		t := time.NewTicker(s.keepalive)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.conn.Close()
+				return
+			case <-t.C:
+				if err := s.write("GET_PARAMETER", s.requestURL(), nil); err != nil {
+					logger.Printf("rtsp: keepalive error: %s", err)
+				}
+			}
+		}
+	}()
+
+	d := newDepacketizer(s.track)
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+		first, err := s.br.Peek(1)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if first[0] != '$' {
+			// keepalive responses
+			if _, err := s.readResponse(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		channel, payload, err := s.readFrame()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if channel != 0 {
+			// rtcp
+			continue
+		}
+
+		if au := d.decode(payload); au != nil {
+			if err := fn(au); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func parseSDP(body []byte) (*rtspTrack, error) {
+	var (
+		track   *rtspTrack
+		inVideo bool
+		fmtp    string
+	)
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "m=") {
+			if track != nil {
+				break
+			}
+			inVideo = strings.HasPrefix(line, "m=video")
+			if inVideo {
+				track = &rtspTrack{}
+				if fields := strings.Fields(line); len(fields) >= 4 {
+					pt, _ := strconv.Atoi(fields[3])
+					track.payloadType = uint8(pt)
+				}
+			}
+			continue
+		}
+
+		if !inVideo || track == nil {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+			if len(fields) != 2 {
+				continue
+			}
+			switch enc := strings.ToUpper(strings.SplitN(fields[1], "/", 2)[0]); enc {
+			case "H264":
+				track.codec = codecH264
+			case "H265", "HEVC":
+				track.codec = codecH265
+			}
+
+		case strings.HasPrefix(line, "a=fmtp:"):
+			fmtp = line
+
+		case strings.HasPrefix(line, "a=control:"):
+			track.control = strings.TrimPrefix(line, "a=control:")
+		}
+	}
+
+	if track == nil || track.codec == "" {
+		return nil, errNoVideoTrack
+	}
+
+	if i := strings.Index(fmtp, " "); i != -1 {
+		for _, kv := range strings.Split(fmtp[i+1:], ";") {
+			parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "sprop-parameter-sets", "sprop-vps", "sprop-sps", "sprop-pps":
+				for _, p := range strings.Split(parts[1], ",") {
+					if nalu, err := base64.StdEncoding.DecodeString(p); err == nil && len(nalu) > 0 {
+						track.params = append(track.params, nalu)
+					}
+				}
+			}
+		}
+	}
+
+	return track, nil
+}
+
+// depacketizer rebuilds access units from H.264 (RFC 6184) or
+// H.265 (RFC 7798) RTP packets.
+type depacketizer struct {
+	codec string
+
+	params map[int][]byte
+
+	nalus   [][]byte
+	fu      []byte
+	ts      uint32
+	seq     uint16
+	started bool
+	broken  bool
+	// after a packet loss the next frames reference missing data, they
+	// are dropped until a clean keyframe
+	waitKey bool
+	pts     int64
+	lastTS  uint32
+	hasPTS  bool
+}
+
+func newDepacketizer(track *rtspTrack) *depacketizer {
+	d := &depacketizer{
+		codec:  track.codec,
+		params: make(map[int][]byte),
+	}
+	for _, p := range track.params {
+		d.cacheParam(p)
+	}
+	return d
+}
+
+func (d *depacketizer) naluType(nalu []byte) int {
+	if d.codec == codecH265 {
+		return int(nalu[0]>>1) & 0x3f
+	}
+	return int(nalu[0]) & 0x1f
+}
+
+func (d *depacketizer) isParam(t int) bool {
+	if d.codec == codecH265 {
+		return t >= 32 && t <= 34
+	}
+	return t == 7 || t == 8
+}
+
+func (d *depacketizer) isKey(t int) bool {
+	if d.codec == codecH265 {
+		return t >= 16 && t <= 21
+	}
+	return t == 5
+}
+
+func (d *depacketizer) isAUD(t int) bool {
+	if d.codec == codecH265 {
+		return t == 35
+	}
+	return t == 9
+}
+
+func (d *depacketizer) cacheParam(nalu []byte) {
+	if len(nalu) == 0 {
+		return
+	}
+	if t := d.naluType(nalu); d.isParam(t) {
+		d.params[t] = append([]byte(nil), nalu...)
+	}
+}
+
+// decode consumes a rtp packet and returns an access unit when one is complete.
+func (d *depacketizer) decode(pkt []byte) *accessUnit {
+	if len(pkt) < 12 || pkt[0]>>6 != 2 {
+		return nil
+	}
+
+	padding := pkt[0]&0x20 != 0
+	extension := pkt[0]&0x10 != 0
+	csrc := int(pkt[0] & 0x0f)
+	marker := pkt[1]&0x80 != 0
+	seq := binary.BigEndian.Uint16(pkt[2:])
+	ts := binary.BigEndian.Uint32(pkt[4:])
+
+	offset := 12 + csrc*4
+	if extension {
+		if len(pkt) < offset+4 {
+			return nil
+		}
+		offset += 4 + int(binary.BigEndian.Uint16(pkt[offset+2:]))*4
+	}
+	end := len(pkt)
+	if padding && end > 0 {
+		end -= int(pkt[end-1])
+	}
+	if offset >= end {
+		return nil
+	}
+	payload := pkt[offset:end]
+
+	lost := d.started && seq != d.seq+1
+	if lost {
+		// the next frames may reference the lost data
+		d.waitKey = true
+	}
+
+	var au *accessUnit
+	newFrame := !d.started || ts != d.ts || len(d.nalus)+len(d.fu) == 0
+	if d.started && ts != d.ts && len(d.nalus)+len(d.fu) > 0 {
+		// the marker was lost with the last packets of the pending frame
+		if lost {
+			d.broken = true
+		}
+		au = d.flush()
+	}
+
+	if lost && !(newFrame && d.startsPicture(payload)) {
+		// packet loss inside the current frame
+		d.fu = nil
+		d.broken = true
+	}
+	d.started = true
+	d.seq = seq
+	d.ts = ts
+
+	d.unpack(payload)
+
+	if marker && au == nil {
+		au = d.flush()
+	}
+	return au
+}
+
+// startsPicture tells if the first nal unit of a rtp payload is the
+// beginning of a frame: a parameter set, an access unit delimiter, sei or
+// the first slice of the picture.
+func (d *depacketizer) startsPicture(payload []byte) bool {
+	var header []byte
+	if d.codec == codecH265 {
+		if len(payload) < 4 {
+			return false
+		}
+		switch t := int(payload[0]>>1) & 0x3f; t {
+		case 48:
+			if len(payload) < 6 {
+				return false
+			}
+			header = payload[4:]
+		case 49:
+			if payload[2]&0x80 == 0 {
+				return false
+			}
+			header = append([]byte{payload[0]&0x81 | (payload[2]&0x3f)<<1, payload[1]}, payload[3:]...)
+		default:
+			header = payload
+		}
+		if len(header) < 3 {
+			return false
+		}
+		t := d.naluType(header)
+		if d.isParam(t) || d.isAUD(t) || t == 39 {
+			return true
+		}
+		// first_slice_segment_in_pic_flag
+		return t < 32 && header[2]&0x80 != 0
+	}
+
+	if len(payload) < 2 {
+		return false
+	}
+	switch t := payload[0] & 0x1f; t {
+	case 24:
+		if len(payload) < 4 {
+			return false
+		}
+		header = payload[3:]
+	case 28:
+		if payload[1]&0x80 == 0 {
+			return false
+		}
+		header = append([]byte{payload[0]&0xe0 | payload[1]&0x1f}, payload[2:]...)
+	default:
+		header = payload
+	}
+	if len(header) < 2 {
+		return false
+	}
+	t := d.naluType(header)
+	if d.isParam(t) || d.isAUD(t) || t == 6 {
+		return true
+	}
+	// first_mb_in_slice is 0
+	return t >= 1 && t <= 5 && header[1]&0x80 != 0
+}
+
+func (d *depacketizer) unpack(payload []byte) {
+	if d.codec == codecH265 {
+		if len(payload) < 3 {
+			return
+		}
+		switch t := int(payload[0]>>1) & 0x3f; t {
+		case 48: // aggregation packet
+			for p := payload[2:]; len(p) > 2; {
+				size := int(binary.BigEndian.Uint16(p))
+				if size == 0 || size > len(p)-2 {
+					return
+				}
+				d.nalus = append(d.nalus, append([]byte(nil), p[2:2+size]...))
+				p = p[2+size:]
+			}
+		case 49: // fragmentation unit
+			fuHeader := payload[2]
+			if fuHeader&0x80 != 0 {
+				nalType := fuHeader & 0x3f
+				d.fu = []byte{(payload[0] & 0x81) | nalType<<1, payload[1]}
+			} else if d.fu == nil {
+				return
+			}
+			d.fu = append(d.fu, payload[3:]...)
+			if fuHeader&0x40 != 0 {
+				d.nalus = append(d.nalus, d.fu)
+				d.fu = nil
+			}
+		default:
+			d.nalus = append(d.nalus, append([]byte(nil), payload...))
+		}
+		return
+	}
+
+	switch t := payload[0] & 0x1f; t {
+	case 24: // STAP-A
+		for p := payload[1:]; len(p) > 2; {
+			size := int(binary.BigEndian.Uint16(p))
+			if size == 0 || size > len(p)-2 {
+				return
+			}
+			d.nalus = append(d.nalus, append([]byte(nil), p[2:2+size]...))
+			p = p[2+size:]
+		}
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return
+		}
+		fuHeader := payload[1]
+		if fuHeader&0x80 != 0 {
+			d.fu = []byte{(payload[0] & 0xe0) | (fuHeader & 0x1f)}
+		} else if d.fu == nil {
+			return
+		}
+		d.fu = append(d.fu, payload[2:]...)
+		if fuHeader&0x40 != 0 {
+			d.nalus = append(d.nalus, d.fu)
+			d.fu = nil
+		}
+	default:
+		d.nalus = append(d.nalus, append([]byte(nil), payload...))
+	}
+}
+
+func (d *depacketizer) flush() *accessUnit {
+	nalus := d.nalus
+	broken := d.broken || d.fu != nil
+	d.nalus = nil
+	d.fu = nil
+	d.broken = false
+
+	if d.hasPTS {
+		d.pts += int64(int32(d.ts - d.lastTS))
+	}
+	d.lastTS = d.ts
+	d.hasPTS = true
+
+	au := &accessUnit{pts: d.pts}
+	seen := make(map[int]bool)
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		t := d.naluType(nalu)
+		if d.isAUD(t) {
+			continue
+		}
+		if d.isParam(t) {
+			d.cacheParam(nalu)
+			seen[t] = true
+		}
+		if d.isKey(t) {
+			au.key = true
+		}
+		au.nalus = append(au.nalus, nalu)
+	}
+
+	if len(au.nalus) == 0 {
+		return nil
+	}
+	if broken {
+		d.waitKey = true
+		return nil
+	}
+	if d.waitKey {
+		if !au.key {
+			return nil
+		}
+		d.waitKey = false
+	}
+
+	if au.key {
+		// make sure every keyframe is decodable on its own
+		var params [][]byte
+		for _, t := range []int{32, 33, 34, 7, 8} {
+			if p, ok := d.params[t]; ok && !seen[t] {
+				params = append(params, p)
+			}
+		}
+		au.nalus = append(params, au.nalus...)
+	}
+
+	return au
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const rtpMTU = 1200
+
+func init() {
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+}
+
+// readFixture splits an annex-b fixture on its access unit delimiters.
+func readFixture(t *testing.T, codec string) [][][]byte {
+	data, err := ioutil.ReadFile("testdata/stream." + codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &depacketizer{codec: codec}
+	var aus [][][]byte
+	for _, nalu := range bytes.Split(data, []byte{0, 0, 0, 1})[1:] {
+		if d.isAUD(d.naluType(nalu)) {
+			aus = append(aus, nil)
+			continue
+		}
+		aus[len(aus)-1] = append(aus[len(aus)-1], nalu)
+	}
+	return aus
+}
+
+func fixtureParams(codec string, aus [][][]byte) [][]byte {
+	d := &depacketizer{codec: codec}
+	var params [][]byte
+	for _, nalu := range aus[0] {
+		if d.isParam(d.naluType(nalu)) {
+			params = append(params, nalu)
+		}
+	}
+	return params
+}
+
+// packetize builds the rtp packets of an access unit, aggregating the
+// parameter sets and fragmenting nal units bigger than the mtu.
+func packetize(codec string, au [][]byte, seq *uint16, ts uint32) [][]byte {
+	d := &depacketizer{codec: codec}
+	var payloads [][]byte
+
+	var params []byte
+	for _, nalu := range au {
+		if d.isParam(d.naluType(nalu)) {
+			params = binary.BigEndian.AppendUint16(params, uint16(len(nalu)))
+			params = append(params, nalu...)
+		}
+	}
+	if params != nil {
+		if codec == codecH265 {
+			payloads = append(payloads, append([]byte{48 << 1, 1}, params...))
+		} else {
+			payloads = append(payloads, append([]byte{24}, params...))
+		}
+	}
+
+	for _, nalu := range au {
+		if d.isParam(d.naluType(nalu)) {
+			continue
+		}
+		if len(nalu) <= rtpMTU {
+			payloads = append(payloads, nalu)
+			continue
+		}
+		var header []byte
+		body := nalu
+		if codec == codecH265 {
+			header = []byte{49 << 1, 1, byte(d.naluType(nalu))}
+			body = nalu[2:]
+		} else {
+			header = []byte{nalu[0]&0xe0 | 28, nalu[0] & 0x1f}
+			body = nalu[1:]
+		}
+		fu := len(header) - 1
+		for first := true; len(body) > 0; first = false {
+			n := rtpMTU
+			if n > len(body) {
+				n = len(body)
+			}
+			p := append([]byte(nil), header...)
+			if first {
+				p[fu] |= 0x80
+			}
+			if n == len(body) {
+				p[fu] |= 0x40
+			}
+			payloads = append(payloads, append(p, body[:n]...))
+			body = body[n:]
+		}
+	}
+
+	pkts := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		pkt := make([]byte, 12, 12+len(payload))
+		pkt[0] = 0x80
+		pkt[1] = 96
+		if i == len(payloads)-1 {
+			pkt[1] |= 0x80
+		}
+		binary.BigEndian.PutUint16(pkt[2:], *seq)
+		binary.BigEndian.PutUint32(pkt[4:], ts)
+		binary.BigEndian.PutUint32(pkt[8:], 0x1234)
+		pkts[i] = append(pkt, payload...)
+		*seq++
+	}
+	return pkts
+}
+
+// rtspTestServer plays back a fixture to a single client over rtp
+// interleaved on tcp, requiring digest authentication.
+type rtspTestServer struct {
+	codec string
+	aus   [][][]byte
+	ln    net.Listener
+
+	mu       sync.Mutex
+	requests []string
+}
+
+const (
+	testRTSPUser  = "admin"
+	testRTSPPass  = "secret"
+	testRTSPRealm = "camera"
+	testRTSPNonce = "0123456789abcdef"
+)
+
+func newRTSPTestServer(t *testing.T, codec string) *rtspTestServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &rtspTestServer{codec: codec, aus: readFixture(t, codec), ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *rtspTestServer) url() string {
+	return fmt.Sprintf("rtsp://%s:%s@%s/cam", testRTSPUser, testRTSPPass, s.ln.Addr())
+}
+
+func (s *rtspTestServer) sdp() string {
+	var encoded []string
+	for _, p := range fixtureParams(s.codec, s.aus) {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(p))
+	}
+	media := "m=video 0 RTP/AVP 96\r\na=control:trackID=0\r\n"
+	if s.codec == codecH265 {
+		media += "a=rtpmap:96 H265/90000\r\n" + fmt.Sprintf(
+			"a=fmtp:96 sprop-vps=%s; sprop-sps=%s; sprop-pps=%s\r\n", encoded[0], encoded[1], encoded[2])
+	} else {
+		media += "a=rtpmap:96 H264/90000\r\n" +
+			"a=fmtp:96 packetization-mode=1; sprop-parameter-sets=" + strings.Join(encoded, ",") + "\r\n"
+	}
+	return "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=test\r\nt=0 0\r\n" +
+		"m=audio 0 RTP/AVP 0\r\na=control:trackID=1\r\n" + media
+}
+
+func (s *rtspTestServer) authorized(method, uri, header string) bool {
+	params := parseAuthParams(strings.TrimPrefix(header, "Digest "))
+	hex := func(v string) string { return fmt.Sprintf("%x", md5.Sum([]byte(v))) }
+	ha1 := hex(testRTSPUser + ":" + testRTSPRealm + ":" + testRTSPPass)
+	return params["uri"] == uri && params["response"] == hex(ha1+":"+testRTSPNonce+":"+hex(method+":"+uri))
+}
+
+func (s *rtspTestServer) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	tp := textproto.NewReader(bufio.NewReader(conn))
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		parts := strings.Fields(line)
+		method, uri := parts[0], parts[1]
+
+		s.mu.Lock()
+		s.requests = append(s.requests, method+" "+uri)
+		s.mu.Unlock()
+
+		res := fmt.Sprintf("RTSP/1.0 200 OK\r\nCSeq: %s\r\n", header.Get("Cseq"))
+		var body string
+		switch {
+		case !s.authorized(method, uri, header.Get("Authorization")):
+			res = fmt.Sprintf("RTSP/1.0 401 Unauthorized\r\nCSeq: %s\r\n"+
+				"WWW-Authenticate: Basic realm=\"%s\"\r\n"+
+				"WWW-Authenticate: Digest realm=\"%s\", nonce=\"%s\"\r\n",
+				header.Get("Cseq"), testRTSPRealm, testRTSPRealm, testRTSPNonce)
+		case method == "DESCRIBE":
+			body = s.sdp()
+			res += fmt.Sprintf("Content-Base: %s/\r\nContent-Type: application/sdp\r\n", uri)
+		case method == "SETUP":
+			res += "Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\nSession: 12345678;timeout=60\r\n"
+		}
+		res += fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+		if _, err := conn.Write([]byte(res)); err != nil {
+			return
+		}
+
+		if method == "PLAY" {
+			s.play(conn)
+			return
+		}
+	}
+}
+
+func (s *rtspTestServer) play(conn net.Conn) {
+	w := bufio.NewWriter(conn)
+	frame := func(channel byte, payload []byte) {
+		w.Write([]byte{'$', channel, byte(len(payload) >> 8), byte(len(payload))})
+		w.Write(payload)
+	}
+	// rtcp sender report, ignored by the client
+	frame(1, []byte{0x80, 200, 0, 6, 0, 0, 0x12, 0x34, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	seq := uint16(65500) // wraps around
+	for i, au := range s.aus {
+		for _, pkt := range packetize(s.codec, au, &seq, uint32(1000+i*3000)) {
+			frame(0, pkt)
+		}
+	}
+	w.Flush()
+}
+
+func TestRTSPSession(t *testing.T) {
+	for _, codec := range []string{codecH264, codecH265} {
+		t.Run(codec, func(t *testing.T) {
+			srv := newRTSPTestServer(t, codec)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+			s, err := dialRTSP(ctx, srv.url(), time.Second*5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if s.Codec() != codec {
+				t.Errorf("codec = %s, want %s", s.Codec(), codec)
+			}
+
+			var aus []*accessUnit
+			err = s.ReadAccessUnits(ctx, func(au *accessUnit) error {
+				aus = append(aus, au)
+				return nil
+			})
+			if err == nil {
+				t.Error("expected an error when the server closes the connection")
+			}
+
+			base := "rtsp://" + srv.ln.Addr().String() + "/cam"
+			want := []string{
+				"DESCRIBE " + base,
+				"DESCRIBE " + base,
+				"SETUP " + base + "/trackID=0",
+				"PLAY " + base + "/",
+			}
+			srv.mu.Lock()
+			if !reflect.DeepEqual(srv.requests, want) {
+				t.Errorf("requests = %q, want %q", srv.requests, want)
+			}
+			srv.mu.Unlock()
+
+			if len(aus) != len(srv.aus) {
+				t.Fatalf("received %d access units, want %d", len(aus), len(srv.aus))
+			}
+			for i, au := range aus {
+				if au.pts != int64(i*3000) {
+					t.Errorf("au %d: pts = %d, want %d", i, au.pts, i*3000)
+				}
+				if key := i%5 == 0; au.key != key {
+					t.Errorf("au %d: key = %v, want %v", i, au.key, key)
+				}
+				if !reflect.DeepEqual(au.nalus, srv.aus[i]) {
+					t.Errorf("au %d: nal units differ from the fixture", i)
+				}
+			}
+		})
+	}
+}
+
+// depacketize feeds the packets of the fixture, skipping the dropped ones,
+// and returns the index of the access units received.
+func depacketize(t *testing.T, codec string, drop func(au, pkt, last int) bool) []int {
+	aus := readFixture(t, codec)
+	d := newDepacketizer(&rtspTrack{codec: codec, params: fixtureParams(codec, aus)})
+
+	var got []int
+	seq := uint16(0)
+	for i, au := range aus {
+		pkts := packetize(codec, au, &seq, uint32(i*3000))
+		for j, pkt := range pkts {
+			if drop(i, j, len(pkts)-1) {
+				continue
+			}
+			if out := d.decode(pkt); out != nil {
+				got = append(got, int(out.pts/3000))
+			}
+		}
+	}
+	return got
+}
+
+func TestDepacketizerLoss(t *testing.T) {
+	for _, codec := range []string{codecH264, codecH265} {
+		t.Run(codec, func(t *testing.T) {
+			tests := []struct {
+				name string
+				drop func(au, pkt, last int) bool
+				want []int
+			}{
+				{
+					name: "no loss",
+					drop: func(au, pkt, last int) bool { return false },
+					want: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+				},
+				{
+					// the keyframe that follows is intact
+					name: "last fragment of a keyframe",
+					drop: func(au, pkt, last int) bool { return au == 5 && pkt == last },
+					want: []int{0, 1, 2, 3, 4, 10, 11},
+				},
+				{
+					name: "last packet before a keyframe",
+					drop: func(au, pkt, last int) bool { return au == 4 && pkt == last },
+					want: []int{0, 1, 2, 3, 5, 6, 7, 8, 9, 10, 11},
+				},
+				{
+					// parameter sets are cached from the sdp
+					name: "parameter sets of a keyframe",
+					drop: func(au, pkt, last int) bool { return au == 5 && pkt == 0 },
+					want: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+				},
+				{
+					name: "first fragment of a keyframe",
+					drop: func(au, pkt, last int) bool { return au == 5 && pkt == 1 },
+					want: []int{0, 1, 2, 3, 4, 10, 11},
+				},
+				{
+					name: "middle fragment",
+					drop: func(au, pkt, last int) bool { return au == 0 && pkt == 2 },
+					want: []int{5, 6, 7, 8, 9, 10, 11},
+				},
+				{
+					// the next frames reference the lost one
+					name: "whole frame",
+					drop: func(au, pkt, last int) bool { return au == 2 },
+					want: []int{0, 1, 5, 6, 7, 8, 9, 10, 11},
+				},
+			}
+			for _, tt := range tests {
+				if got := depacketize(t, codec, tt.drop); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+type tsPES struct {
+	pts    int64
+	random bool
+	annexB []byte
+}
+
+// demuxTS checks the packets and tables and returns the video pes.
+func demuxTS(t *testing.T, data []byte, codec string) []*tsPES {
+	if len(data)%tsPacketSize != 0 {
+		t.Fatalf("ts size %d is not a multiple of %d", len(data), tsPacketSize)
+	}
+	wantType := byte(0x1b)
+	if codec == codecH265 {
+		wantType = 0x24
+	}
+
+	var (
+		pes    []*tsPES
+		cc     = map[uint16]int{}
+		tables int
+	)
+	for off := 0; off < len(data); off += tsPacketSize {
+		p := data[off : off+tsPacketSize]
+		if p[0] != 0x47 {
+			t.Fatalf("packet %d: bad sync byte", off/tsPacketSize)
+		}
+		pid := uint16(p[1]&0x1f)<<8 | uint16(p[2])
+		pusi := p[1]&0x40 != 0
+		if last, ok := cc[pid]; ok && int(p[3]&0x0f) != (last+1)&0x0f {
+			t.Errorf("pid %d: continuity counter jumped from %d to %d", pid, last, p[3]&0x0f)
+		}
+		cc[pid] = int(p[3] & 0x0f)
+
+		payload := p[4:]
+		random := false
+		if p[3]&0x20 != 0 {
+			afLen := int(p[4])
+			if afLen > 0 {
+				random = p[5]&0x40 != 0
+			}
+			payload = p[5+afLen:]
+		}
+
+		switch pid {
+		case 0:
+			section := payload[1:]
+			size := 3 + int(binary.BigEndian.Uint16(section[1:])&0x0fff)
+			if tsCRC32(section[:size]) != 0 {
+				t.Error("pat: bad crc")
+			}
+			if pmt := binary.BigEndian.Uint16(section[10:]) & 0x1fff; pmt != tsPMTPID {
+				t.Errorf("pat: pmt pid = %d", pmt)
+			}
+		case tsPMTPID:
+			section := payload[1:]
+			size := 3 + int(binary.BigEndian.Uint16(section[1:])&0x0fff)
+			if tsCRC32(section[:size]) != 0 {
+				t.Error("pmt: bad crc")
+			}
+			if section[12] != wantType {
+				t.Errorf("pmt: stream type = %#x, want %#x", section[12], wantType)
+			}
+			tables++
+		case tsVideoPID:
+			if pusi {
+				if !bytes.HasPrefix(payload, []byte{0, 0, 1, 0xe0}) {
+					t.Fatal("pes: bad start code")
+				}
+				h := payload[9:]
+				pts := int64(h[0]>>1&0x07)<<30 | int64(h[1])<<22 | int64(h[2]>>1)<<15 | int64(h[3])<<7 | int64(h[4]>>1)
+				pes = append(pes, &tsPES{pts: pts - tsPTSOffset, random: random})
+				payload = payload[9+int(payload[8]):]
+			}
+			if len(pes) == 0 {
+				t.Fatal("video payload before the first pes")
+			}
+			pes[len(pes)-1].annexB = append(pes[len(pes)-1].annexB, payload...)
+		default:
+			t.Fatalf("unexpected pid %d", pid)
+		}
+	}
+	if tables == 0 {
+		t.Error("no pmt written")
+	}
+	return pes
+}
+
+func TestTSMuxer(t *testing.T) {
+	for _, codec := range []string{codecH264, codecH265} {
+		t.Run(codec, func(t *testing.T) {
+			aus := readFixture(t, codec)
+			var buf bytes.Buffer
+			mux := newTSMuxer(&buf, codec)
+			for i, nalus := range aus {
+				au := &accessUnit{pts: int64(i * 3000), key: i%5 == 0, nalus: nalus}
+				if err := mux.WriteAccessUnit(au, au.pts); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pes := demuxTS(t, buf.Bytes(), codec)
+			if len(pes) != len(aus) {
+				t.Fatalf("%d pes, want %d", len(pes), len(aus))
+			}
+			aud := h264AUD
+			if codec == codecH265 {
+				aud = h265AUD
+			}
+			for i, p := range pes {
+				if p.pts != int64(i*3000) {
+					t.Errorf("pes %d: pts = %d, want %d", i, p.pts, i*3000)
+				}
+				if key := i%5 == 0; p.random != key {
+					t.Errorf("pes %d: random access = %v, want %v", i, p.random, key)
+				}
+				want := append([]byte(nil), aud...)
+				for _, nalu := range aus[i] {
+					want = append(append(want, 0, 0, 0, 1), nalu...)
+				}
+				if !bytes.Equal(p.annexB, want) {
+					t.Errorf("pes %d: payload differs from the access unit", i)
+				}
+			}
+		})
+	}
+}
+
+// TestRTSPToTS records a whole session as ts, like the native recorder.
+func TestRTSPToTS(t *testing.T) {
+	for _, codec := range []string{codecH264, codecH265} {
+		t.Run(codec, func(t *testing.T) {
+			srv := newRTSPTestServer(t, codec)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+			s, err := dialRTSP(ctx, srv.url(), time.Second*5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			var buf bytes.Buffer
+			mux := newTSMuxer(&buf, s.Codec())
+			s.ReadAccessUnits(ctx, func(au *accessUnit) error {
+				return mux.WriteAccessUnit(au, au.pts)
+			})
+
+			pes := demuxTS(t, buf.Bytes(), codec)
+			if len(pes) != len(srv.aus) {
+				t.Fatalf("%d pes, want %d", len(pes), len(srv.aus))
+			}
+		})
+	}
+}
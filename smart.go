@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSMARTInterval = time.Minute * 10
+	defaultMaxTemp       = 55
+
+	// temperature samples kept for the trend, a day at the default interval
+	smartHistory = 144
+)
+
+// SMART reads the health of the storage disks with smartctl.
+type SMART struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// passed as smartctl -d, usb disks usually need sat
+	DeviceType     string `yaml:"device_type"`
+	MaxTemperature int    `yaml:"max_temperature"`
+}
+
+// diskHealth is the last smartctl reading of a storage disk.
+type diskHealth struct {
+	Storage       string    `json:"storage"`
+	Device        string    `json:"device"`
+	Model         string    `json:"model,omitempty"`
+	Serial        string    `json:"serial,omitempty"`
+	Passed        bool      `json:"passed"`
+	Temperature   int       `json:"temperature"`
+	MaxTemp       int       `json:"max_temperature"`
+	TempTrend     int       `json:"temperature_trend"`
+	Reallocated   int64     `json:"reallocated_sectors"`
+	Pending       int64     `json:"pending_sectors"`
+	Uncorrectable int64     `json:"uncorrectable_sectors"`
+	MediaErrors   int64     `json:"media_errors"`
+	PowerOnHours  int64     `json:"power_on_hours"`
+	Checked       time.Time `json:"checked"`
+	Error         string    `json:"error,omitempty"`
+
+	read    bool // false until smartctl succeeds once
+	temps   []int
+	hotSent bool
+}
+
+// healthy is false when the disk fails its self assessment or has bad
+// sectors. A disk never read is healthy.
+func (d *diskHealth) healthy() bool {
+	return !d.read ||
+		d.Passed && d.Pending == 0 && d.Uncorrectable == 0 && d.MediaErrors == 0
+}
+
+var (
+	smartMu     sync.Mutex
+	smartStates = make(map[*Storage]*diskHealth)
+)
+
+func smartMonitor() {
+	interval := config.SMART.Interval
+	if interval <= 0 {
+		interval = defaultSMARTInterval
+	}
+	logger.Printf("smart: checking disks every %s", interval)
+	for {
+		checkSMART()
+		time.Sleep(interval)
+	}
+}
+
+func checkSMART() {
+	for _, s := range storages {
+		// only storages with a disk of their own
+		if s.MountDev == "" && s.MountUUID == "" && s.MountLabel == "" {
+			continue
+		}
+		if !s.mounted() {
+			continue
+		}
+		dev, err := s.device()
+		if err != nil {
+			logger.Printf("smart: can't resolve device of %s: %s", s.Name, err)
+			continue
+		}
+
+		cur, err := readSMART(dev)
+		if err == errStandby {
+			continue
+		}
+		cur.Storage, cur.Device = s.Name, dev
+		cur.MaxTemp = config.SMART.MaxTemperature
+		if cur.MaxTemp <= 0 {
+			cur.MaxTemp = defaultMaxTemp
+		}
+		if err != nil {
+			logger.Printf("smart: error reading %s (%s): %s", s.Name, dev, err)
+			cur.Error = err.Error()
+		}
+
+		smartMu.Lock()
+		prev, ok := smartStates[s]
+		if err != nil {
+			// keeps the last good reading
+			if ok {
+				prev.Error, prev.Checked = cur.Error, cur.Checked
+			} else {
+				smartStates[s] = cur
+			}
+			smartMu.Unlock()
+			continue
+		}
+		if !ok {
+			prev = &diskHealth{}
+		}
+		cur.temps = append(prev.temps, cur.Temperature)
+		if len(cur.temps) > smartHistory {
+			cur.temps = cur.temps[len(cur.temps)-smartHistory:]
+		}
+		cur.TempTrend = cur.Temperature - cur.temps[0]
+		cur.hotSent = prev.hotSent
+		events := smartEvents(prev, cur, prev.read)
+		smartStates[s] = cur
+		smartMu.Unlock()
+
+		for _, e := range events {
+			logger.Printf("smart: %s", e)
+			if cur.healthy() {
+				notifyf(eventDisk, s.Name, "Disk %s (%s): %s", s.Name, dev, e)
+			} else {
+				notifyCriticalf(eventDisk, s.Name, "Disk %s (%s): %s", s.Name, dev, e)
+			}
+		}
+		if len(events) > 0 && s == currentStorage() && !cur.healthy() {
+			led.BadHD()
+		}
+	}
+}
+
+// smartEvents lists what got worse since the previous reading. Bad
+// sectors found on the first reading are reported too.
+func smartEvents(prev, cur *diskHealth, compare bool) []string {
+	var events []string
+	if !compare {
+		prev = &diskHealth{Passed: true}
+	}
+	if prev.Passed && !cur.Passed {
+		events = append(events, "SMART self assessment FAILED, replace the disk")
+	}
+	for _, a := range []struct {
+		name      string
+		prev, cur int64
+	}{
+		{"reallocated sectors", prev.Reallocated, cur.Reallocated},
+		{"pending sectors", prev.Pending, cur.Pending},
+		{"uncorrectable sectors", prev.Uncorrectable, cur.Uncorrectable},
+		{"media errors", prev.MediaErrors, cur.MediaErrors},
+	} {
+		if a.cur > a.prev {
+			events = append(events, fmt.Sprintf("%s increased from %d to %d", a.name, a.prev, a.cur))
+		}
+	}
+
+	switch {
+	case cur.Temperature >= cur.MaxTemp && !cur.hotSent:
+		cur.hotSent = true
+		events = append(events, fmt.Sprintf("temperature is %d°C (max %d°C, %+d°C on the last readings)", cur.Temperature, cur.MaxTemp, cur.TempTrend))
+	case cur.Temperature < cur.MaxTemp-5 && cur.hotSent:
+		cur.hotSent = false
+		events = append(events, fmt.Sprintf("temperature is back to %d°C", cur.Temperature))
+	}
+	return events
+}
+
+var errStandby = errors.New("disk in standby")
+
+// readSMART runs smartctl on dev. Disks in standby are not woken up.
+func readSMART(dev string) (*diskHealth, error) {
+	d := &diskHealth{Checked: time.Now()}
+	args := []string{"-j", "-a", "-n", "standby"}
+	if config.SMART.DeviceType != "" {
+		args = append(args, "-d", safeShell(config.SMART.DeviceType))
+	}
+	out, err := exec.Command("smartctl", append(args, dev)...).Output()
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		return d, err
+	}
+
+	var res struct {
+		Smartctl struct {
+			Messages []struct {
+				String string `json:"string"`
+			} `json:"messages"`
+		} `json:"smartctl"`
+		ModelName    string `json:"model_name"`
+		SerialNumber string `json:"serial_number"`
+		SmartStatus  *struct {
+			Passed bool `json:"passed"`
+		} `json:"smart_status"`
+		Temperature struct {
+			Current int `json:"current"`
+		} `json:"temperature"`
+		PowerOnTime struct {
+			Hours int64 `json:"hours"`
+		} `json:"power_on_time"`
+		ATASmartAttributes struct {
+			Table []struct {
+				ID  int `json:"id"`
+				Raw struct {
+					Value int64 `json:"value"`
+				} `json:"raw"`
+			} `json:"table"`
+		} `json:"ata_smart_attributes"`
+		NVMeLog *struct {
+			MediaErrors int64 `json:"media_errors"`
+		} `json:"nvme_smart_health_information_log"`
+	}
+	if jerr := json.Unmarshal(out, &res); jerr != nil {
+		return d, fmt.Errorf("smartctl exit %d: %s", code, jerr)
+	}
+
+	var msgs []string
+	for _, m := range res.Smartctl.Messages {
+		msgs = append(msgs, m.String)
+	}
+	// bit 0: command line error, bit 1: device open failed or in standby
+	if code&3 != 0 {
+		if strings.Contains(strings.ToUpper(strings.Join(msgs, " ")), "STANDBY") {
+			return d, errStandby
+		}
+		return d, fmt.Errorf("smartctl exit %d: %s", code, strings.Join(msgs, "; "))
+	}
+	if res.SmartStatus == nil {
+		return d, fmt.Errorf("no smart data: %s", strings.Join(msgs, "; "))
+	}
+
+	d.read = true
+	d.Model, d.Serial = res.ModelName, res.SerialNumber
+	d.Passed = res.SmartStatus.Passed
+	d.Temperature = res.Temperature.Current
+	d.PowerOnHours = res.PowerOnTime.Hours
+	for _, a := range res.ATASmartAttributes.Table {
+		switch a.ID {
+		case 5:
+			d.Reallocated = a.Raw.Value
+		case 197:
+			d.Pending = a.Raw.Value
+		case 198:
+			d.Uncorrectable = a.Raw.Value
+		}
+	}
+	if res.NVMeLog != nil {
+		d.MediaErrors = res.NVMeLog.MediaErrors
+	}
+	return d, nil
+}
+
+// diskHealthy tells if the disk of the storage has no SMART failures.
+func (s *Storage) diskHealthy() bool {
+	smartMu.Lock()
+	defer smartMu.Unlock()
+	d, ok := smartStates[s]
+	return !ok || d.healthy()
+}
+
+func disksHealth() []diskHealth {
+	smartMu.Lock()
+	defer smartMu.Unlock()
+	disks := []diskHealth{}
+	for _, s := range storages {
+		if d, ok := smartStates[s]; ok {
+			disks = append(disks, *d)
+		}
+	}
+	return disks
+}
+
+func serverSMART() string {
+	if !config.SMART.Enabled {
+		return "disabled"
+	}
+	disks := disksHealth()
+	if len(disks) == 0 {
+		return "no readings yet"
+	}
+	var b strings.Builder
+	for _, d := range disks {
+		status := "OK"
+		if !d.healthy() {
+			status = "FAILING"
+		}
+		fmt.Fprintf(&b, "%s (%s) %s %s: %s\n", d.Storage, d.Device, d.Model, d.Serial, status)
+		fmt.Fprintf(&b, "  temperature: %d°C (%+d°C), power on: %dh\n", d.Temperature, d.TempTrend, d.PowerOnHours)
+		fmt.Fprintf(&b, "  reallocated: %d, pending: %d, uncorrectable: %d, media errors: %d\n", d.Reallocated, d.Pending, d.Uncorrectable, d.MediaErrors)
+		fmt.Fprintf(&b, "  checked: %s", d.Checked.Format(time.RubyDate))
+		if d.Error != "" {
+			fmt.Fprintf(&b, " (last error: %s)", d.Error)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	storageCheckInterval = time.Minute
+)
+
+// Storage is a place to keep recordings. Storages are used in the config
+// order, recording fails over to the next healthy one.
+type Storage struct {
+	Name       string `yaml:"name"`
+	VideosDir  string `yaml:"videos_dir"`
+	MountDir   string `yaml:"mount_dir"`
+	MountDev   string `yaml:"mount_dev"`
+	MountLabel string `yaml:"mount_label"`
+	MountUUID  string `yaml:"mount_uuid"`
+	// detected with blkid when empty
+	MountFSType  string `yaml:"mount_fs_type"`
+	MountOptions string `yaml:"mount_options"`
+	// checks and repairs the filesystem before mounting
+	MountFsck bool `yaml:"mount_fsck"`
+	// fails over when retention can't keep that much free space
+	MinFreeBytes ByteSize `yaml:"min_free_bytes"`
+	// replaces the global retention on this storage
+	Retention *Retention `yaml:"retention"`
+
+	lastMountErr string
+	lastFsck     time.Time
+}
+
+var (
+	storages []*Storage
+
+	storageMu     sync.RWMutex
+	activeStorage *Storage
+
+	migrating bool
+
+	errNoRoom    = errors.New("no room left")
+	errNoStorage = errors.New("no storage is mounted")
+)
+
+// initStorages builds the storage list. The top level videos_dir and
+// mount options are used when no storage is declared.
+func initStorages() {
+	storages = nil
+	for i := range config.Storages {
+		s := config.Storages[i]
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("storage %d", i+1)
+		}
+		storages = append(storages, &s)
+	}
+	if len(storages) == 0 {
+		storages = []*Storage{{
+			Name:       "default",
+			VideosDir:  config.VideosDir,
+			MountDir:   config.MountDir,
+			MountDev:   config.MountDev,
+			MountLabel: config.MountLabel,
+
+			MountUUID:    config.MountUUID,
+			MountFSType:  config.MountFSType,
+			MountOptions: config.MountOptions,
+			MountFsck:    config.MountFsck,
+		}}
+	}
+
+	for _, s := range storages {
+		if s.VideosDir == "" {
+			logger.Printf("no videos_dir defined for %s, using default value", s.Name)
+			s.VideosDir = "./cameras"
+		}
+		s.MountDir = safeShell(s.MountDir)
+		s.MountDev = safeShell(s.MountDev)
+		s.MountLabel = safeShell(s.MountLabel)
+		s.MountUUID = safeShell(s.MountUUID)
+		s.MountFSType = safeShell(s.MountFSType)
+		s.MountOptions = safeShell(s.MountOptions)
+	}
+
+	storageMu.Lock()
+	activeStorage = storages[0]
+	storageMu.Unlock()
+}
+
+// currentStorage is the storage receiving the recordings.
+func currentStorage() *Storage {
+	storageMu.RLock()
+	defer storageMu.RUnlock()
+	return activeStorage
+}
+
+// storageOf returns the storage holding file, the current one when unknown.
+func storageOf(file string) *Storage {
+	for _, s := range storages {
+		if strings.HasPrefix(file, strings.TrimSuffix(s.VideosDir, "/")+"/") {
+			return s
+		}
+	}
+	return currentStorage()
+}
+
+// mountedStorages returns the mounted storages, once per videos dir.
+func mountedStorages() []*Storage {
+	var mounted []*Storage
+	done := make(map[string]bool)
+	for _, s := range storages {
+		if done[s.VideosDir] || !s.mounted() {
+			continue
+		}
+		done[s.VideosDir] = true
+		mounted = append(mounted, s)
+	}
+	return mounted
+}
+
+func videosDir() string {
+	return currentStorage().VideosDir
+}
+
+// healthy tells if the storage can receive recordings.
+func (s *Storage) healthy() (bool, string) {
+	if !s.mounted() {
+		return false, "not mounted"
+	}
+	if ok, reason := s.writable(); !ok {
+		return false, reason
+	}
+	if err := os.MkdirAll(s.VideosDir, 0774); err != nil {
+		return false, err.Error()
+	}
+	if s.MinFreeBytes > 0 {
+		free, _, err := diskUsage(s.VideosDir)
+		if err != nil {
+			return false, err.Error()
+		}
+		if free < uint64(s.MinFreeBytes) {
+			return false, fmt.Sprintf("only %.1fGB free", float64(free)/(1<<30))
+		}
+	}
+	return true, ""
+}
+
+// pickStorage returns the first healthy storage, mounting the ones not
+// mounted when mount is set. A storage under its capacity floor is still
+// picked if none is above it.
+func pickStorage(mount bool) *Storage {
+	var full *Storage
+	for _, s := range storages {
+		if mount && !s.mounted() {
+			s.mount()
+		}
+		ok, reason := s.healthy()
+		if ok {
+			return s
+		}
+		if full == nil && s.mounted() {
+			full = s
+		}
+		if config.Debug {
+			logger.Printf("storage %s is unhealthy: %s", s.Name, reason)
+		}
+	}
+	return full
+}
+
+// checkStorages switches to the first healthy storage. Recordings left on
+// lower priority storages are moved back in background.
+// Returns nil when no storage can be used.
+func checkStorages() *Storage {
+	next := pickStorage(true)
+	if next == nil {
+		return nil
+	}
+
+	prev := currentStorage()
+	if next != prev {
+		storageMu.Lock()
+		activeStorage = next
+		storageMu.Unlock()
+
+		if storageIndex(next) < storageIndex(prev) {
+			logger.Printf("storage: %s is back, switched from %s", next.Name, prev.Name)
+			notifyf(eventStorage, next.Name, "Storage %s is back, recording switched from %s to it", next.Name, prev.Name)
+		} else {
+			_, reason := prev.healthy()
+			logger.Printf("storage: switched from %s (%s) to %s", prev.Name, reason, next.Name)
+			notifyCriticalf(eventStorage, prev.Name, "Recording switched from %s (%s) to %s", prev.Name, reason, next.Name)
+		}
+	}
+
+	go migrateBack(next)
+	return next
+}
+
+// selectStorage uses the first healthy storage without mounting, for the
+// command line tools.
+func selectStorage() {
+	if s := pickStorage(false); s != nil {
+		storageMu.Lock()
+		activeStorage = s
+		storageMu.Unlock()
+	}
+}
+
+func storageWatcher() {
+	for range time.NewTicker(storageCheckInterval).C {
+		if checkStorages() == nil {
+			led.BadHD()
+			logger.Println("storage: no storage available")
+		}
+	}
+}
+
+func storageIndex(s *Storage) int {
+	for i := range storages {
+		if storages[i] == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// migrateBack moves recordings from storages after dst to dst.
+func migrateBack(dst *Storage) {
+	storageMu.Lock()
+	if migrating {
+		storageMu.Unlock()
+		return
+	}
+	migrating = true
+	storageMu.Unlock()
+	defer func() {
+		storageMu.Lock()
+		migrating = false
+		storageMu.Unlock()
+	}()
+
+	for _, src := range storages[storageIndex(dst)+1:] {
+		if src.VideosDir == dst.VideosDir || !src.mounted() {
+			continue
+		}
+		moved, err := migrate(src, dst)
+		// retention makes room for the rest
+		if err == errNoRoom && !config.Debug {
+			err = nil
+		}
+		if err != nil {
+			logger.Printf("storage: error migrating %s to %s: %s", src.Name, dst.Name, err)
+		}
+		if moved > 0 {
+			logger.Printf("storage: %d files migrated from %s to %s", moved, src.Name, dst.Name)
+			notifyf(eventStorage, src.Name, "%d files migrated back from %s to %s", moved, src.Name, dst.Name)
+		}
+	}
+}
+
+// hasRoom tells if size bytes fit on the storage leaving it over its
+// failover floor, so migrations don't make it fail over again.
+func (s *Storage) hasRoom(size int64) bool {
+	free, _, err := diskUsage(s.VideosDir)
+	return err == nil && free >= uint64(s.MinFreeBytes+storageHeadroom)+uint64(size)
+}
+
+// migrate moves day directories and finished ts files from src to dst,
+// while dst has room for them.
+func migrate(src, dst *Storage) (int, error) {
+	dirs, err := ioutil.ReadDir(src.VideosDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var moved int
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(dayDirLayout, d.Name()); err != nil {
+			continue
+		}
+		if currentStorage() != dst {
+			return moved, fmt.Errorf("%s is not in use anymore", dst.Name)
+		}
+
+		n, err := migrateDir(path.Join(src.VideosDir, d.Name()), path.Join(dst.VideosDir, d.Name()), func(f os.FileInfo) bool {
+			return f.Name() != indexFileName
+		}, dst.hasRoom)
+		moved += n
+		if n > 0 {
+			enqueue(jobReindex, path.Join(dst.VideosDir, d.Name()), priorityLow)
+		}
+		if err != nil {
+			return moved, err
+		}
+		os.Remove(path.Join(src.VideosDir, d.Name(), indexFileName))
+		os.Remove(path.Join(src.VideosDir, d.Name()))
+	}
+
+	// recordings not converted yet, skipping the ones still being written
+	var tmp []string
+	n, err := migrateDir(path.Join(src.VideosDir, ".tmp"), path.Join(dst.VideosDir, ".tmp"), func(f os.FileInfo) bool {
+		name := f.Name()
+		ok := strings.HasPrefix(name, "rec_") && strings.HasSuffix(name, ".ts") &&
+			time.Since(f.ModTime()) > reindexMinAge
+		if ok {
+			tmp = append(tmp, path.Join(dst.VideosDir, ".tmp", name))
+		}
+		return ok
+	}, dst.hasRoom)
+	moved += n
+	for _, file := range tmp {
+		if _, err := os.Stat(file); err == nil {
+			enqueue(jobConvert, file, priorityNormal)
+		}
+	}
+	return moved, err
+}
+
+// migrateDir moves the files of src accepted by filter to dst, failing
+// when one has no room. Files already on dst are kept.
+func migrateDir(src, dst string, filter func(f os.FileInfo) bool, room func(size int64) bool) (int, error) {
+	files, err := ioutil.ReadDir(src)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dst, 0774); err != nil {
+		return 0, err
+	}
+
+	var moved int
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !filter(f) {
+			continue
+		}
+		to := path.Join(dst, f.Name())
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+		if !room(f.Size()) {
+			return moved, errNoRoom
+		}
+		if err := moveFile(path.Join(src, f.Name()), to); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+type storageInfo struct {
+	Name      string `json:"name"`
+	VideosDir string `json:"videos_dir"`
+	Active    bool   `json:"active"`
+	Healthy   bool   `json:"healthy"`
+	Reason    string `json:"reason,omitempty"`
+	Free      uint64 `json:"free"`
+	Total     uint64 `json:"total"`
+}
+
+func storagesStatus() []storageInfo {
+	current := currentStorage()
+	var infos []storageInfo
+	for _, s := range storages {
+		i := storageInfo{
+			Name:      s.Name,
+			VideosDir: s.VideosDir,
+			Active:    s == current,
+		}
+		i.Healthy, i.Reason = s.healthy()
+		if s.mounted() {
+			i.Free, i.Total, _ = diskUsage(s.VideosDir)
+		}
+		infos = append(infos, i)
+	}
+	return infos
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSystemInterval = time.Minute
+	defaultMaxCPUTemp     = 80
+	defaultMaxMemory      = 90
+)
+
+// SystemMonitor thresholds, telegram is notified when they are crossed.
+type SystemMonitor struct {
+	Interval       time.Duration `yaml:"interval"`
+	MaxTemperature float64       `yaml:"max_temperature"`
+	// percent of memory in use
+	MaxMemory float64 `yaml:"max_memory"`
+	// 1 minute load average, twice the number of cpus when empty
+	MaxLoad float64 `yaml:"max_load"`
+}
+
+type thermalZone struct {
+	Type        string  `json:"type"`
+	Temperature float64 `json:"temperature"`
+}
+
+type systemInfo struct {
+	Temperature float64       `json:"temperature"`
+	Zones       []thermalZone `json:"thermal_zones"`
+
+	// vcgencmd get_throttled, only on raspberry pi
+	Throttled      *uint64  `json:"throttled,omitempty"`
+	UnderVoltage   bool     `json:"under_voltage"`
+	Throttling     bool     `json:"throttling"`
+	FreqCapped     bool     `json:"freq_capped"`
+	SoftTempLimit  bool     `json:"soft_temp_limit"`
+	ThrottledSince []string `json:"throttled_since_boot"`
+
+	MemTotal     uint64  `json:"mem_total"`
+	MemAvailable uint64  `json:"mem_available"`
+	MemUsed      float64 `json:"mem_used_percent"`
+
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+	CPUs   int     `json:"cpus"`
+
+	Checked time.Time `json:"checked"`
+	Errors  []string  `json:"errors,omitempty"`
+}
+
+// get_throttled bits, the ones after 16 are sticky since boot
+var throttledBits = []struct {
+	bit  uint
+	name string
+}{
+	{0, "under-voltage"},
+	{1, "arm frequency capped"},
+	{2, "throttled"},
+	{3, "soft temperature limit"},
+}
+
+var (
+	systemMu     sync.Mutex
+	systemState  systemInfo
+	systemAlerts = make(map[string]bool)
+)
+
+func systemMonitor() {
+	interval := config.System.Interval
+	if interval <= 0 {
+		interval = defaultSystemInterval
+	}
+	for {
+		info := readSystem()
+		systemMu.Lock()
+		prev := systemState
+		systemState = info
+		systemMu.Unlock()
+		systemEvents(prev, info)
+		time.Sleep(interval)
+	}
+}
+
+func currentSystem() systemInfo {
+	systemMu.Lock()
+	defer systemMu.Unlock()
+	if systemState.Checked.IsZero() {
+		systemState = readSystem()
+	}
+	return systemState
+}
+
+func readSystem() systemInfo {
+	info := systemInfo{Checked: time.Now(), CPUs: runtime.NumCPU()}
+	fail := func(err error) {
+		info.Errors = append(info.Errors, err.Error())
+	}
+
+	zones, err := readThermalZones()
+	if err != nil {
+		fail(err)
+	}
+	info.Zones = zones
+	for _, z := range zones {
+		if z.Temperature > info.Temperature {
+			info.Temperature = z.Temperature
+		}
+	}
+
+	if t, err := vcgencmdThrottled(); err == nil {
+		info.Throttled = &t
+		info.UnderVoltage = t&(1<<0) != 0
+		info.FreqCapped = t&(1<<1) != 0
+		info.Throttling = t&(1<<2) != 0
+		info.SoftTempLimit = t&(1<<3) != 0
+		for _, b := range throttledBits {
+			if t&(1<<(b.bit+16)) != 0 {
+				info.ThrottledSince = append(info.ThrottledSince, b.name)
+			}
+		}
+	}
+
+	if mem, err := readMeminfo(); err != nil {
+		fail(err)
+	} else {
+		info.MemTotal, info.MemAvailable = mem["MemTotal"], mem["MemAvailable"]
+		if info.MemTotal > 0 {
+			info.MemUsed = 100 * float64(info.MemTotal-info.MemAvailable) / float64(info.MemTotal)
+		}
+	}
+
+	if data, err := ioutil.ReadFile("/proc/loadavg"); err != nil {
+		fail(err)
+	} else if _, err := fmt.Sscanf(string(data), "%f %f %f", &info.Load1, &info.Load5, &info.Load15); err != nil {
+		fail(fmt.Errorf("invalid /proc/loadavg: %s", err))
+	}
+	return info
+}
+
+func readThermalZones() ([]thermalZone, error) {
+	dirs, err := filepath.Glob("/sys/class/thermal/thermal_zone*")
+	if err != nil {
+		return nil, err
+	}
+	var zones []thermalZone
+	for _, dir := range dirs {
+		data, err := ioutil.ReadFile(path.Join(dir, "temp"))
+		if err != nil {
+			continue
+		}
+		milli, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+		if err != nil {
+			continue
+		}
+		z := thermalZone{Type: path.Base(dir), Temperature: milli / 1000}
+		if t, err := ioutil.ReadFile(path.Join(dir, "type")); err == nil {
+			z.Type = strings.TrimSpace(string(t))
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// vcgencmdThrottled parses "throttled=0x50005".
+func vcgencmdThrottled() (uint64, error) {
+	out, err := exec.Command("vcgencmd", "get_throttled").Output()
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimPrefix(strings.TrimSpace(string(out)), "throttled=")
+	return strconv.ParseUint(s, 0, 64)
+}
+
+// readMeminfo returns the /proc/meminfo values in bytes.
+func readMeminfo() (map[string]uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mem := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			v *= 1024
+		}
+		mem[strings.TrimSuffix(fields[0], ":")] = v
+	}
+	return mem, scanner.Err()
+}
+
+// systemEvents notifies when a threshold is crossed and when it's back
+// to normal.
+func systemEvents(prev, cur systemInfo) {
+	maxTemp := config.System.MaxTemperature
+	if maxTemp <= 0 {
+		maxTemp = defaultMaxCPUTemp
+	}
+	maxMem := config.System.MaxMemory
+	if maxMem <= 0 {
+		maxMem = defaultMaxMemory
+	}
+	maxLoad := config.System.MaxLoad
+	if maxLoad <= 0 {
+		maxLoad = float64(2 * cur.CPUs)
+	}
+
+	alert := func(name string, on bool, msg, back string) {
+		systemMu.Lock()
+		was := systemAlerts[name]
+		systemAlerts[name] = on
+		systemMu.Unlock()
+		switch {
+		case on && !was:
+			logger.Printf("system: %s", msg)
+			notifyf(eventSystem, name, "%s", msg)
+		case !on && was:
+			logger.Printf("system: %s", back)
+			notifyf(eventSystem, name, "%s", back)
+		}
+	}
+
+	alert("temperature", cur.Temperature >= maxTemp,
+		fmt.Sprintf("CPU temperature is %.1f°C (max %.0f°C)", cur.Temperature, maxTemp),
+		fmt.Sprintf("CPU temperature is back to %.1f°C", cur.Temperature))
+	alert("under-voltage", cur.UnderVoltage,
+		"Under-voltage detected, check the power supply. Recordings may be dropped",
+		"Voltage is back to normal")
+	alert("throttling", cur.Throttling,
+		"CPU is being throttled. Recordings may be dropped",
+		"CPU is not throttled anymore")
+	alert("memory", cur.MemUsed >= maxMem,
+		fmt.Sprintf("Memory usage is %.0f%% (max %.0f%%)", cur.MemUsed, maxMem),
+		fmt.Sprintf("Memory usage is back to %.0f%%", cur.MemUsed))
+	alert("load", cur.Load1 >= maxLoad,
+		fmt.Sprintf("Load average is %.2f (max %.2f)", cur.Load1, maxLoad),
+		fmt.Sprintf("Load average is back to %.2f", cur.Load1))
+
+	// sticky bits catch events between two readings, the ones still
+	// active were notified above
+	if prev.Throttled != nil && cur.Throttled != nil {
+		if added := (*cur.Throttled &^ *prev.Throttled) >> 16 &^ *cur.Throttled; added != 0 {
+			var events []string
+			for _, b := range throttledBits {
+				if added&(1<<b.bit) != 0 {
+					events = append(events, b.name)
+				}
+			}
+			logger.Printf("system: occurred since last check: %s", strings.Join(events, ", "))
+			notifyf(eventSystem, "throttled", "Occurred since last check: %s", strings.Join(events, ", "))
+		}
+	}
+}
+
+func serverSystem() string {
+	info := currentSystem()
+	var b strings.Builder
+	fmt.Fprintf(&b, "CPU temperature: %.1f°C\n", info.Temperature)
+	for _, z := range info.Zones {
+		fmt.Fprintf(&b, "  %s: %.1f°C\n", z.Type, z.Temperature)
+	}
+	if info.Throttled != nil {
+		fmt.Fprintf(&b, "Throttled: 0x%x", *info.Throttled)
+		var now []string
+		for _, bit := range throttledBits {
+			if *info.Throttled&(1<<bit.bit) != 0 {
+				now = append(now, bit.name)
+			}
+		}
+		if len(now) > 0 {
+			fmt.Fprintf(&b, " NOW: %s", strings.Join(now, ", "))
+		}
+		if len(info.ThrottledSince) > 0 {
+			fmt.Fprintf(&b, " since boot: %s", strings.Join(info.ThrottledSince, ", "))
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "Memory: %.0f%% used, %.0fMB available of %.0fMB\n",
+		info.MemUsed, float64(info.MemAvailable)/(1<<20), float64(info.MemTotal)/(1<<20))
+	fmt.Fprintf(&b, "Load: %.2f %.2f %.2f (%d cpus)\n", info.Load1, info.Load5, info.Load15, info.CPUs)
+	for _, err := range info.Errors {
+		fmt.Fprintf(&b, "error: %s\n", err)
+	}
+	return b.String()
+}
@@ -75,13 +75,18 @@ func (t *RequestTask) do() error {
 	bodyText := string(body)
 
 	if t.Expect != "" && !strings.Contains(bodyText, t.Expect) {
-		fmt.Errorf("received unexpected result. expected %s, got %s", t.Expect, bodyText)
+		return fmt.Errorf("received unexpected result. expected %s, got %s", t.Expect, bodyText)
 	}
 
 	return nil
 }
 
 func (t *Task) run(data map[string]string) (string, error) {
+	if t.Action != nil {
+		t.Action(data)
+		return "[done]", nil
+	}
+
 	if t.Command != nil {
 		out, err := exec.Command("bash", "-c", replaceWithConf(*t.Command, data)).Output()
 		if err != nil {
@@ -114,4 +119,27 @@ func registerBuiltinTasks() {
 			reboot()
 		},
 	}
+
+	// builds yesterday's timelapse, useful to test the timelapse config
+	taskByName["timelapse"] = &Task{
+		Name: "timelapse",
+		Action: func(data map[string]string) {
+			generateTimelapses(time.Now().AddDate(0, 0, -1))
+		},
+	}
+
+	// verifies and repairs every recording, reporting to telegram
+	taskByName["fsck"] = &Task{
+		Name: "fsck",
+		Action: func(data map[string]string) {
+			report, err := fsck(nil, nil)
+			if err != nil {
+				logger.Printf("fsck: %s", err)
+				notifyf(eventTask, "fsck", "fsck failed: %s", err)
+				return
+			}
+			logger.Printf("fsck: %s", report)
+			notifyf(eventTask, "fsck", "fsck: %s", report)
+		},
+	}
 }
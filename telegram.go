@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -17,7 +18,7 @@ import (
 
 var (
 	b         *tb.Bot
-	notifyCh  chan TelegramNotification
+	notifyCh  chan Notification
 	customCMD map[string]func(m *tb.Message)
 
 	botClient = &http.Client{
@@ -27,15 +28,10 @@ var (
 
 func init() {
 	const queueSize = 20
-	notifyCh = make(chan TelegramNotification, 20)
+	notifyCh = make(chan Notification, 20)
 	customCMD = make(map[string]func(m *tb.Message))
 }
 
-type TelegramNotification struct {
-	Text   string
-	Images []string
-}
-
 func sendNotifications() {
 	for {
 		if b == nil {
@@ -55,28 +51,30 @@ func sendNotifications() {
 				for _, p := range photos {
 					b.Send(chat, p)
 				}
+				for _, v := range msg.Videos {
+					b.Send(chat, &tb.Video{File: tb.FromDisk(v), FileName: path.Base(v)})
+				}
 			}
 		}
 	}
 }
 
-func telegramNotify(msg TelegramNotification) {
-	if config.TelegramBot.Token == "" {
-		return
-	}
+// telegramNotifier sends to the monitors of the bot.
+type telegramNotifier struct{}
+
+func (telegramNotifier) Name() string {
+	return "telegram"
+}
+
+func (telegramNotifier) Notify(msg Notification) error {
 	select {
 	case notifyCh <- msg:
+		return nil
 	default:
-		logger.Printf("telegram queue is full, can't send %v", msg)
+		return errors.New("telegram queue is full")
 	}
 }
 
-func telegramNotifyf(format string, a ...interface{}) {
-	telegramNotify(TelegramNotification{
-		Text: fmt.Sprintf(format, a...),
-	})
-}
-
 func telegramBot() {
 	if config.TelegramBot.Token == "" {
 		return
@@ -250,7 +248,7 @@ func telegramBot() {
 
 		b.Handle(c("/testmonitors"), func(c telebot.Context) error {
 			m := c.Message()
-			telegramNotifyf("This is monitor test. If you see it its all good")
+			notifyCriticalf(eventGeneral, "", "This is monitor test. If you see it its all good")
 			b.Send(m.Sender, "test sent!")
 			return nil
 		})
@@ -457,7 +455,7 @@ func telegramBot() {
 				dir = "."
 			}
 
-			dirPath := path.Join(videosDir, dir)
+			dirPath := path.Join(videosDir(), dir)
 			files, err := ioutil.ReadDir(dirPath)
 			if err != nil {
 				b.Send(m.Sender, fmt.Sprintf("Error opening %s: %s", dirPath, err))
@@ -499,7 +497,11 @@ func telegramBot() {
 		})
 
 		custom("/remove", func(m *tb.Message) {
-			file := path.Join(videosDir, strings.TrimSpace(strings.ReplaceAll(m.Payload, "../", "")))
+			file := path.Join(videosDir(), strings.TrimSpace(strings.ReplaceAll(m.Payload, "../", "")))
+			if err := checkRemovable(m.Payload); err != nil {
+				b.Send(m.Sender, fmt.Sprintf("can't remove '%s': %s", file, err))
+				return
+			}
 			err := os.RemoveAll(file)
 			if err != nil {
 				b.Send(m.Sender, fmt.Sprintf("error removing '%s'", file))
@@ -508,13 +510,136 @@ func telegramBot() {
 			b.Send(m.Sender, fmt.Sprintf("'%s' removed", file))
 		})
 
+		custom("/protect", func(m *tb.Message) {
+			if fields := strings.Fields(m.Payload); len(fields) == 3 {
+				from, err := parseTime(fields[1])
+				var to time.Time
+				if err == nil {
+					to, err = parseTime(fields[2])
+				}
+				if err == nil {
+					err = protectRange(fields[0], from, to)
+				}
+				if err != nil {
+					b.Send(m.Sender, fmt.Sprintf("can't protect: %s\n\nEx.: /protect camera 2006-01-02T15:04 2006-01-02T16:00", err))
+					return
+				}
+				b.Send(m.Sender, fmt.Sprintf("🔒 %s protected from %s to %s", fields[0], from.Format("02/01/2006 15:04"), to.Format("02/01/2006 15:04")))
+				return
+			}
+
+			if err := protectFile(m.Payload); err != nil {
+				b.Send(m.Sender, fmt.Sprintf("can't protect '%s': %s", m.Payload, err))
+				return
+			}
+			b.Send(m.Sender, fmt.Sprintf("🔒 '%s' protected", cleanRel(m.Payload)))
+		})
+
+		custom("/unprotect", func(m *tb.Message) {
+			if fields := strings.Fields(m.Payload); len(fields) == 3 {
+				for _, r := range protectedRanges() {
+					if r.Camera == fields[0] && r.From.Format("2006-01-02T15:04") == fields[1] && r.To.Format("2006-01-02T15:04") == fields[2] {
+						if err := unprotectRange(r); err != nil {
+							b.Send(m.Sender, fmt.Sprintf("can't unprotect: %s", err))
+							return
+						}
+						b.Send(m.Sender, "🔓 range unprotected")
+						return
+					}
+				}
+				b.Send(m.Sender, "no such protected range")
+				return
+			}
+
+			if err := unprotectFile(m.Payload); err != nil {
+				b.Send(m.Sender, fmt.Sprintf("can't unprotect '%s': %s", m.Payload, err))
+				return
+			}
+			b.Send(m.Sender, fmt.Sprintf("🔓 '%s' unprotected", cleanRel(m.Payload)))
+		})
+
+		b.Handle(c("/protected"), func(c telebot.Context) error {
+			m := c.Message()
+			var msg []string
+			for _, f := range protectedFiles() {
+				msg = append(msg, click("🔓 /unprotect", f))
+			}
+			for _, r := range protectedRanges() {
+				msg = append(msg, fmt.Sprintf(
+					"🔒 /unprotect %s %s %s",
+					r.Camera,
+					r.From.Format("2006-01-02T15:04"),
+					r.To.Format("2006-01-02T15:04"),
+				))
+			}
+			if len(msg) == 0 {
+				b.Send(m.Sender, "Nothing is protected")
+				return nil
+			}
+			b.Send(m.Sender, fmt.Sprintf("Protected recordings:\n\n%s", strings.Join(msg, "\n\n")))
+			return nil
+		})
+
+		b.Handle(c("/export"), func(c telebot.Context) error {
+			m := c.Message()
+			fields := strings.Fields(m.Payload)
+			if len(fields) != 3 {
+				b.Send(m.Sender, "Ex.: /export camera 2006-01-02T15:04 2006-01-02T16:00")
+				return nil
+			}
+			from, err := parseTime(fields[1])
+			var to time.Time
+			if err == nil {
+				to, err = parseTime(fields[2])
+			}
+			var j *exportJob
+			if err == nil {
+				j, err = startExport(fields[0], from, to)
+			}
+			if err != nil {
+				b.Send(m.Sender, fmt.Sprintf("can't export: %s", err))
+				return nil
+			}
+
+			b.Send(m.Sender, fmt.Sprintf("Exporting %s... (job %s)", fields[0], j.ID), tb.Silent)
+			go func() {
+				t := time.NewTicker(time.Second * 10)
+				defer t.Stop()
+				reported := 0.0
+				for waiting := true; waiting; {
+					select {
+					case <-t.C:
+						if p := j.snapshot().Progress; p-reported >= 0.25 {
+							reported = p
+							b.Send(m.Sender, fmt.Sprintf("Exporting... %.0f%%", p*100), tb.Silent)
+						}
+					case <-j.done:
+						waiting = false
+					}
+				}
+
+				s := j.snapshot()
+				if s.Status != exportDone {
+					b.Send(m.Sender, fmt.Sprintf("Export failed: %s", s.Error))
+					return
+				}
+				if !config.TelegramBot.AllowUpload {
+					b.Send(m.Sender, fmt.Sprintf("Export finished: %s", s.File))
+					return
+				}
+				b.Send(m.Sender, "Export finished.", tb.Silent)
+				telegramUpload(m.Sender, s.output)
+			}()
+			return nil
+		})
+
 		custom("/upload", func(m *tb.Message) {
 			if !config.TelegramBot.AllowUpload {
 				b.Send(m.Sender, "Upload is not allowed!")
 				return
 			}
 
-			file := path.Join(videosDir, strings.TrimSpace(strings.ReplaceAll(m.Payload, "../", "")))
+			file := path.Join(videosDir(), strings.TrimSpace(strings.ReplaceAll(m.Payload, "../", "")))
 			info, err := os.Stat(file)
 			if os.IsNotExist(err) {
 				b.Send(m.Sender, fmt.Sprintf("file %s doesn't exists", file))
@@ -529,9 +654,7 @@ func telegramBot() {
 				return
 			}
 
-			b.Send(m.Sender, "Uploading ...")
-			doc := &tb.Document{File: tb.FromDisk(file)}
-			b.Send(m.Sender, doc)
+			telegramUpload(m.Sender, file)
 		})
 
 		b.Start()
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	posterSuffix = ".jpg"
+	spriteSuffix = ".sprite.jpg"
+	vttSuffix    = ".vtt"
+
+	spriteThumbWidth  = 160
+	spriteThumbHeight = 90
+	spriteColumns     = 10
+	spriteMaxThumbs   = 100
+	spriteMinInterval = 5
+)
+
+// sidecars returns the files generated for a video.
+func sidecars(video string) []string {
+	return []string{
+		video + posterSuffix,
+		video + spriteSuffix,
+		video + vttSuffix,
+	}
+}
+
+func isSidecar(name string) bool {
+	for _, suffix := range []string{posterSuffix, vttSuffix, ".json", ".txt"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// generateThumbnails creates a poster, a sprite sheet and a webvtt track
+// pointing to the sprite tiles, stored alongside the video.
+func generateThumbnails(video string) error {
+	secs, err := videoDuration(video)
+	if err != nil {
+		return err
+	}
+
+	poster := video + posterSuffix
+	out, err := exec.Command(
+		ffmpeg,
+		"-nostdin", "-y",
+		"-ss", fmt.Sprintf("%.3f", math.Min(1, secs/2)),
+		"-i", video,
+		"-frames:v", "1",
+		"-vf", "scale=640:-2",
+		poster,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("poster: %s: %s", err, lastLines(string(out), 3))
+	}
+
+	interval := math.Max(spriteMinInterval, math.Ceil(secs/spriteMaxThumbs))
+	thumbs := int(math.Ceil(secs / interval))
+	if thumbs < 1 {
+		thumbs = 1
+	}
+	rows := int(math.Ceil(float64(thumbs) / spriteColumns))
+
+	sprite := video + spriteSuffix
+	out, err = exec.Command(
+		ffmpeg,
+		"-nostdin", "-y",
+		"-skip_frame", "nokey",
+		"-i", video,
+		"-vf", fmt.Sprintf(
+			"fps=1/%.0f,scale=%d:%d,tile=%dx%d",
+			interval, spriteThumbWidth, spriteThumbHeight, spriteColumns, rows,
+		),
+		"-frames:v", "1",
+		"-vsync", "vfr",
+		sprite,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sprite: %s: %s", err, lastLines(string(out), 3))
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n\n")
+	for i := 0; i < thumbs; i++ {
+		start := time.Duration(float64(i) * interval * float64(time.Second))
+		end := time.Duration(math.Min(float64(i+1)*interval, secs) * float64(time.Second))
+		fmt.Fprintf(&vtt, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			vttTime(start), vttTime(end),
+			path.Base(sprite),
+			(i%spriteColumns)*spriteThumbWidth, (i/spriteColumns)*spriteThumbHeight,
+			spriteThumbWidth, spriteThumbHeight,
+		)
+	}
+	return ioutil.WriteFile(video+vttSuffix, []byte(vtt.String()), 0664)
+}
+
+func vttTime(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
+
+func removeSidecars(video string) {
+	for _, f := range sidecars(video) {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			logger.Printf("error removing %s: %s", f, err)
+		}
+	}
+}
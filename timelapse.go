@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	timelapsePrefix = "timelapse_"
+)
+
+// Timelapse ...
+type Timelapse struct {
+	Enabled bool `yaml:"enabled"`
+	// time of the day to generate the previous day timelapse
+	At time.Duration `yaml:"at"`
+	// one frame is taken every interval of footage
+	Interval time.Duration `yaml:"interval"`
+	FPS      int           `yaml:"fps"`
+	Height   int           `yaml:"height"`
+	Notify   bool          `yaml:"notify"`
+	Cameras  []string      `yaml:"cameras"`
+}
+
+func timelapsed() {
+	tl := config.Timelapse
+	if !tl.Enabled {
+		return
+	}
+	if tl.At <= 0 {
+		tl.At = time.Hour
+	}
+	logger.Printf("timelapse scheduled to %s every day", tl.At)
+
+	for {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		next := midnight.Add(tl.At)
+		if !next.After(now) {
+			next = midnight.AddDate(0, 0, 1).Add(tl.At)
+		}
+		time.Sleep(time.Until(next))
+
+		generateTimelapses(time.Now().AddDate(0, 0, -1))
+	}
+}
+
+// generateTimelapses builds the timelapse of each camera for day.
+func generateTimelapses(day time.Time) {
+	tl := config.Timelapse
+	cameras := tl.Cameras
+	if len(cameras) == 0 {
+		for _, c := range config.Cameras {
+			cameras = append(cameras, c.Name)
+		}
+	}
+
+	recs, err := listRecordings(videosDir())
+	if err != nil {
+		logger.Printf("timelapse: error listing recordings: %s", err)
+		return
+	}
+
+	dayDir := day.Format(dayDirLayout)
+	for _, camera := range cameras {
+		var segments []recording
+		for _, rec := range recs {
+			if rec.camera == camera && !rec.timelapse && path.Dir(rec.rel) == dayDir {
+				segments = append(segments, rec)
+			}
+		}
+		if len(segments) == 0 {
+			logger.Printf("timelapse: no recordings of %s on %s", camera, dayDir)
+			continue
+		}
+
+		out, err := timelapse(camera, dayDir, segments)
+		if err != nil {
+			logger.Printf("timelapse: error generating %s of %s: %s", dayDir, camera, err)
+			continue
+		}
+		logger.Printf("timelapse: %s generated", out)
+		verifyRecording(out)
+
+		if !tl.Notify {
+			continue
+		}
+		msg := Notification{
+			Text:   fmt.Sprintf("Timelapse of camera %s on %s", camera, day.Format("02/01/2006")),
+			Event:  eventTimelapse,
+			Source: camera,
+		}
+		if info, err := os.Stat(out); err == nil && info.Size() <= telegramUploadLimit {
+			msg.Videos = []string{out}
+		} else {
+			msg.Text += fmt.Sprintf(" (too big to be sent, see %s)", path.Join(dayDir, path.Base(out)))
+		}
+		notify(msg)
+	}
+}
+
+func timelapse(camera, dayDir string, segments []recording) (string, error) {
+	tl := config.Timelapse
+	interval := tl.Interval
+	if interval <= 0 {
+		interval = time.Second * 10
+	}
+	fps := tl.FPS
+	if fps <= 0 {
+		fps = 30
+	}
+	height := tl.Height
+	if height <= 0 {
+		height = 720
+	}
+
+	out := path.Join(videosDir(), dayDir, timelapsePrefix+camera+".mp4")
+
+	listPath := path.Join(videosDir(), ".tmp", timelapsePrefix+camera+".txt")
+	var list strings.Builder
+	for _, rec := range segments {
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(rec.path, "'", `'\''`))
+	}
+	if err := ioutil.WriteFile(listPath, []byte(list.String()), 0664); err != nil {
+		return "", err
+	}
+	defer os.Remove(listPath)
+
+	cmdOut, err := exec.Command(
+		ffmpeg,
+		"-nostdin", "-nostats", "-y",
+		// only keyframes are decoded, way cheaper on the pi
+		"-skip_frame", "nokey",
+		"-f", "concat", "-safe", "0",
+		"-i", listPath,
+		"-vf", fmt.Sprintf("fps=1/%f,setpts=N/(%d*TB),scale=-2:%d", interval.Seconds(), fps, height),
+		"-r", fmt.Sprint(fps),
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "28",
+		"-pix_fmt", "yuv420p",
+		"-movflags", "+faststart",
+		out,
+	).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, lastLines(string(cmdOut), 3))
+	}
+	return out, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"vigilantpi/db"
+)
+
+const (
+	jobDowngrade = "downgrade"
+
+	downgradeInterval = time.Hour
+)
+
+// Profile is a transcode profile, referenced by name on cameras and
+// on the downgrade config.
+type Profile struct {
+	// h264, h265 or copy (default)
+	Codec string `yaml:"codec"`
+	// ffmpeg encoder to try first, e.g. h264_v4l2m2m.
+	// libx264/libx265 are used when it fails.
+	Encoder    string `yaml:"encoder"`
+	CRF        int    `yaml:"crf"`
+	Bitrate    string `yaml:"bitrate"`
+	MaxBitrate string `yaml:"max_bitrate"`
+	Preset     string `yaml:"preset"`
+	Width      int    `yaml:"width"`
+	Height     int    `yaml:"height"`
+	FPS        int    `yaml:"fps"`
+}
+
+// Downgrade ...
+type Downgrade struct {
+	Enabled bool `yaml:"enabled"`
+	// recordings older than that are re-encoded with profile
+	AfterDays int      `yaml:"after_days"`
+	Profile   string   `yaml:"profile"`
+	Cameras   []string `yaml:"cameras"`
+}
+
+func profileByName(name string) (Profile, bool) {
+	if name == "" {
+		return Profile{}, false
+	}
+	p, ok := config.Profiles[name]
+	if !ok {
+		logger.Printf("profile %s is not declared, copying streams", name)
+	}
+	return p, ok
+}
+
+func (p Profile) copy() bool {
+	return p.Codec == "" || p.Codec == "copy"
+}
+
+func (p Profile) softwareEncoder() string {
+	switch strings.ToLower(p.Codec) {
+	case "h265", "hevc":
+		return "libx265"
+	default:
+		return "libx264"
+	}
+}
+
+// encoders returns the encoders to try, in order.
+func (p Profile) encoders() []string {
+	sw := p.softwareEncoder()
+	if p.Encoder == "" || p.Encoder == sw {
+		return []string{sw}
+	}
+	return []string{p.Encoder, sw}
+}
+
+func (p Profile) args(in, out, encoder string) []string {
+	args := []string{"-nostdin", "-y", "-i", in}
+	if p.copy() {
+		args = append(args, "-c", "copy")
+	} else {
+		args = append(args, "-map", "0:v", "-map", "0:a?", "-c:v", encoder)
+
+		software := strings.HasPrefix(encoder, "lib")
+		if p.CRF > 0 && software {
+			args = append(args, "-crf", strconv.Itoa(p.CRF))
+		}
+		if p.Bitrate != "" && !(p.CRF > 0 && software) {
+			// crf has precedence, bitrate is kept for hardware encoders
+			args = append(args, "-b:v", p.Bitrate)
+		}
+		if p.MaxBitrate != "" {
+			args = append(args, "-maxrate", p.MaxBitrate, "-bufsize", p.MaxBitrate)
+		}
+		if p.Preset != "" && software {
+			args = append(args, "-preset", p.Preset)
+		}
+
+		var filters []string
+		if p.Width > 0 || p.Height > 0 {
+			w, h := p.Width, p.Height
+			if w <= 0 {
+				w = -2
+			}
+			if h <= 0 {
+				h = -2
+			}
+			filters = append(filters, fmt.Sprintf("scale=%d:%d", w, h))
+		}
+		if p.FPS > 0 {
+			filters = append(filters, fmt.Sprintf("fps=%d", p.FPS))
+		}
+		if len(filters) > 0 {
+			args = append(args, "-vf", strings.Join(filters, ","))
+		}
+		args = append(args, "-pix_fmt", "yuv420p", "-c:a", "copy")
+
+		if p.softwareEncoder() == "libx265" && strings.EqualFold(filepath.Ext(out), ".mp4") {
+			// plays on apple devices and browsers
+			args = append(args, "-tag:v", "hvc1")
+		}
+	}
+	if strings.EqualFold(filepath.Ext(out), ".mp4") {
+		args = append(args, "-movflags", "+faststart")
+	}
+	return append(args, out)
+}
+
+// transcode converts in to out with the profile, falling back to the
+// software encoder when the configured one fails.
+func transcode(in, out string, p Profile) error {
+	var err error
+	for i, encoder := range p.encoders() {
+		cmdOut, cmdErr := exec.Command(ffmpeg, p.args(in, out, encoder)...).CombinedOutput()
+		if cmdErr == nil {
+			return nil
+		}
+		err = fmt.Errorf("%s: %s", cmdErr, lastLines(string(cmdOut), 3))
+		if p.copy() || i == len(p.encoders())-1 {
+			break
+		}
+		logger.Printf("encoder %s failed on %s, falling back to %s: %s", encoder, in, p.softwareEncoder(), err)
+	}
+	os.Remove(out)
+	return err
+}
+
+func downgraded() {
+	dg := config.Downgrade
+	if !dg.Enabled {
+		return
+	}
+	if _, ok := profileByName(dg.Profile); !ok {
+		logger.Printf("downgrade: invalid profile %q, disabled", dg.Profile)
+		return
+	}
+	if dg.AfterDays <= 0 {
+		dg.AfterDays = 7
+	}
+	logger.Printf("downgrade: recordings older than %d days will use profile %s", dg.AfterDays, dg.Profile)
+
+	for {
+		queueDowngrades(dg)
+		time.Sleep(downgradeInterval)
+	}
+}
+
+// queueDowngrades adds a downgrade job for each recording old enough
+// which wasn't downgraded yet.
+func queueDowngrades(dg Downgrade) {
+	recs, err := listRecordings(videosDir())
+	if err != nil {
+		logger.Printf("downgrade: error listing recordings: %s", err)
+		return
+	}
+
+	done := make(map[string]bool)
+	for _, rel := range db.GetArray("downgraded") {
+		done[rel] = true
+	}
+	existing := make(map[string]bool)
+
+	limit := time.Now().AddDate(0, 0, -dg.AfterDays)
+	for _, rec := range recs {
+		existing[rec.rel] = true
+		if rec.timelapse || done[rec.rel] || !rec.start.Before(limit) || isProtected(rec) || isQuarantined(rec.path) {
+			continue
+		}
+		if len(dg.Cameras) > 0 && !contains(dg.Cameras, rec.camera) {
+			continue
+		}
+		enqueue(jobDowngrade, rec.path, priorityLow)
+	}
+
+	// forgets recordings removed by retention
+	for rel := range done {
+		if !existing[rel] {
+			db.RemoveFromArray("downgraded", rel)
+		}
+	}
+}
+
+// downgrade re-encodes a converted recording in place.
+func downgrade(file string) error {
+	root := storageOf(file).VideosDir
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+	rec, ok := parseRecording(path.Dir(rel), path.Base(rel))
+	if !ok {
+		return fmt.Errorf("%s is not a recording", rel)
+	}
+	rec.path = file
+	if isProtected(rec) || contains(db.GetArray("downgraded"), rec.rel) {
+		return nil
+	}
+
+	p, ok := profileByName(config.Downgrade.Profile)
+	if !ok || p.copy() {
+		return nil
+	}
+
+	// the tmp dir of the same storage, so the file is renamed in place
+	tmpDir := path.Join(root, ".tmp")
+	if err := os.MkdirAll(tmpDir, 0774); err != nil {
+		return err
+	}
+	tmp := path.Join(tmpDir, "downgrade_"+path.Base(file))
+	logger.Printf("downgrade: re-encoding %s", rec.rel)
+	if err := transcode(file, tmp, p); err != nil {
+		return err
+	}
+
+	before, _ := os.Stat(file)
+	if err := moveFile(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if after, err := os.Stat(file); err == nil && before != nil {
+		logger.Printf("downgrade: %s from %.1fMB to %.1fMB", rec.rel,
+			float64(before.Size())/(1<<20), float64(after.Size())/(1<<20))
+	}
+	if entry := verifyRecording(file); !entry.OK {
+		notifyf(eventRecording, rec.camera, "Recording %s is damaged after downgrade: %s", rec.rel, entry.Error)
+	}
+	return db.AppendArray("downgraded", rec.rel)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+const (
+	// bot api refuses uploads bigger than 50MB, keeps some margin
+	telegramUploadLimit = 48 << 20
+
+	// parts can't go below that bitrate and still be watchable
+	minPreviewBitrate = 150_000
+)
+
+func ffprobePath() string {
+	if config.FFProbe != "" {
+		return config.FFProbe
+	}
+	return path.Join(path.Dir(ffmpeg), "ffprobe")
+}
+
+// videoDuration returns the duration of a video in seconds.
+func videoDuration(file string) (float64, error) {
+	out, err := exec.Command(
+		ffprobePath(),
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		file,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe: %s", err)
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+// telegramUpload sends a file as document. Files over the bot upload
+// limit are split into parts that fit, which are sent one by one.
+func telegramUpload(to tb.Recipient, file string) {
+	info, err := os.Stat(file)
+	if err != nil {
+		b.Send(to, fmt.Sprintf("can't upload %s: %s", file, err))
+		return
+	}
+
+	if info.Size() <= telegramUploadLimit {
+		b.Send(to, "Uploading ...", tb.Silent)
+		if _, err := b.Send(to, &tb.Document{File: tb.FromDisk(file), FileName: path.Base(file)}); err != nil {
+			b.Send(to, fmt.Sprintf("upload of %s failed: %s", path.Base(file), err))
+		}
+		return
+	}
+
+	b.Send(to, fmt.Sprintf(
+		"%s has %.1fMB, over the %dMB telegram limit. Splitting...",
+		path.Base(file), float64(info.Size())/(1<<20), telegramUploadLimit>>20,
+	), tb.Silent)
+
+	parts, cleanup, err := splitForUpload(file, info.Size())
+	defer cleanup()
+	if err != nil {
+		b.Send(to, fmt.Sprintf("can't split %s for upload: %s", path.Base(file), err))
+		return
+	}
+
+	for i, part := range parts {
+		b.Send(to, fmt.Sprintf("Uploading part %d/%d ...", i+1, len(parts)), tb.Silent)
+		if _, err := b.Send(to, &tb.Document{File: tb.FromDisk(part), FileName: path.Base(part)}); err != nil {
+			b.Send(to, fmt.Sprintf("upload of part %d/%d failed: %s", i+1, len(parts), err))
+			return
+		}
+	}
+	b.Send(to, fmt.Sprintf("%s uploaded in %d parts", path.Base(file), len(parts)))
+}
+
+// splitForUpload cuts file in parts under the upload limit using stream
+// copy. Parts still too big (long gop) are transcoded to a lower bitrate.
+func splitForUpload(file string, size int64) (parts []string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	secs, err := videoDuration(file)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	if secs <= 0 {
+		return nil, cleanup, fmt.Errorf("invalid duration %f", secs)
+	}
+
+	dir, err := ioutil.TempDir(path.Join(videosDir(), ".tmp"), "upload_")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() {
+		os.RemoveAll(dir)
+	}
+
+	n := int(math.Ceil(float64(size) * 1.2 / telegramUploadLimit))
+	ext := filepath.Ext(file)
+	base := strings.TrimSuffix(path.Base(file), ext)
+
+	out, err := exec.Command(
+		ffmpeg,
+		"-nostdin", "-y",
+		"-i", file,
+		"-c", "copy",
+		"-map", "0",
+		"-f", "segment",
+		"-segment_time", fmt.Sprintf("%.3f", secs/float64(n)),
+		"-reset_timestamps", "1",
+		path.Join(dir, base+"_part%03d"+ext),
+	).CombinedOutput()
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("%s: %s", err, lastLines(string(out), 3))
+	}
+
+	parts, _ = filepath.Glob(path.Join(dir, base+"_part*"+ext))
+	for i, part := range parts {
+		info, err := os.Stat(part)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		if info.Size() <= telegramUploadLimit {
+			continue
+		}
+
+		if parts[i], err = shrinkForUpload(part); err != nil {
+			return nil, cleanup, err
+		}
+	}
+	return parts, cleanup, nil
+}
+
+// shrinkForUpload transcodes a part to a bitrate that fits the limit.
+func shrinkForUpload(part string) (string, error) {
+	secs, err := videoDuration(part)
+	if err != nil {
+		return "", err
+	}
+	bitrate := int(float64(telegramUploadLimit) * 8 * 0.9 / secs)
+	if bitrate < minPreviewBitrate {
+		return "", fmt.Errorf("%s is too long to fit the upload limit", path.Base(part))
+	}
+
+	ext := filepath.Ext(part)
+	preview := strings.TrimSuffix(part, ext) + "_preview.mp4"
+	out, err := exec.Command(
+		ffmpeg,
+		"-nostdin", "-y",
+		"-i", part,
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-b:v", strconv.Itoa(bitrate),
+		"-maxrate", strconv.Itoa(bitrate),
+		"-bufsize", strconv.Itoa(bitrate*2),
+		"-an",
+		"-movflags", "+faststart",
+		preview,
+	).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, lastLines(string(out), 3))
+	}
+	// the bitrate is a target, the encoder may overshoot it
+	info, err := os.Stat(preview)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > telegramUploadLimit {
+		os.Remove(preview)
+		return "", fmt.Errorf("%s is still %.1fMB after shrinking, over the upload limit", path.Base(part), float64(info.Size())/(1<<20))
+	}
+	os.Remove(part)
+	return preview, nil
+}